@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// assignmentRule is an AssignmentRule with its regular expressions compiled.
+type assignmentRule struct {
+	AssignmentRule
+	roomName *regexp.Regexp
+}
+
+// assignmentRules are the rules that are checked, in order, when a
+// conversation is created.
+var assignmentRules []*assignmentRule
+
+// NewAssignmentRules validates the assignment rules from the configuration.
+func NewAssignmentRules(rules []AssignmentRule) ([]*assignmentRule, error) {
+	var compiled []*assignmentRule
+	for i, rule := range rules {
+		if rule.TeamID == 0 && rule.AssigneeID == 0 && rule.Priority == chatwootapi.ConversationPriorityNone {
+			return nil, fmt.Errorf("assignment rule %d must set a team_id, assignee_id, or priority", i)
+		} else if !rule.Priority.IsValid() {
+			return nil, fmt.Errorf("invalid priority %q in assignment rule %d", rule.Priority, i)
+		}
+		r := &assignmentRule{AssignmentRule: rule}
+		if rule.RoomName != "" {
+			var err error
+			r.roomName, err = regexp.Compile(rule.RoomName)
+			if err != nil {
+				return nil, fmt.Errorf("invalid room_name regex in assignment rule %d: %w", i, err)
+			}
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+// conversationInfo is the information about a new conversation that the
+// assignment and label rules match against.
+type conversationInfo struct {
+	// Networks are the ID and display name of the bridge protocol.
+	Networks    []string
+	Homeserver  string
+	RoomName    string
+	MemberCount int
+	ClientType  string
+	Language    string
+}
+
+func (r *assignmentRule) Matches(info *conversationInfo) bool {
+	if r.Network != "" && !containsFold(info.Networks, r.Network) {
+		return false
+	} else if r.Homeserver != "" && !strings.EqualFold(r.Homeserver, info.Homeserver) {
+		return false
+	} else if r.roomName != nil && !r.roomName.MatchString(info.RoomName) {
+		return false
+	} else if r.ClientType != "" && !strings.EqualFold(r.ClientType, info.ClientType) {
+		return false
+	} else if r.Language != "" && !matchesLanguage(info.Language, r.Language) {
+		return false
+	}
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesLanguage returns whether the language tag is the given language or a
+// regional variant of it (for example, de-AT matches de).
+func matchesLanguage(tag, language string) bool {
+	tag = strings.ReplaceAll(tag, "_", "-")
+	return strings.EqualFold(tag, language) ||
+		(len(tag) > len(language) && tag[len(language)] == '-' && strings.EqualFold(tag[:len(language)], language))
+}
+
+// getConversationInfo collects the information that the assignment and label
+// rules match against from the room state. The event is the message that
+// caused the conversation to be created.
+func getConversationInfo(contactMXID id.UserID, state mautrix.RoomStateMap, evt *event.Event) *conversationInfo {
+	info := conversationInfo{Homeserver: contactMXID.Homeserver()}
+
+	if nameEvent, ok := state[event.StateRoomName][""]; ok {
+		info.RoomName = nameEvent.Content.AsRoomName().Name
+	}
+	for _, memberEvent := range state[event.StateMember] {
+		if memberEvent.Content.AsMember().Membership == event.MembershipJoin {
+			info.MemberCount++
+		}
+	}
+	for _, bridgeType := range []event.Type{event.StateBridge, event.StateHalfShotBridge} {
+		for _, bridgeEvent := range state[bridgeType] {
+			protocol := bridgeEvent.Content.AsBridge().Protocol
+			for _, network := range []string{protocol.ID, protocol.DisplayName} {
+				if network != "" {
+					info.Networks = append(info.Networks, network)
+				}
+			}
+		}
+	}
+
+	if evt != nil {
+		info.ClientType, _ = evt.Content.Raw["com.beeper.origin_client_type"].(string)
+		info.Language, _ = evt.Content.Raw["com.beeper.origin_client_language"].(string)
+	}
+	return &info
+}
+
+// applyAssignmentRules assigns the team and agent and sets the priority of a
+// new conversation according to the first assignment rule that matches.
+func applyAssignmentRules(ctx context.Context, conversationID chatwootapi.ConversationID, info *conversationInfo) {
+	log := zerolog.Ctx(ctx).With().Str("component", "apply_assignment_rules").Logger()
+	ctx = log.WithContext(ctx)
+
+	i, rule := findAssignmentRule(assignmentRules, info)
+	if rule == nil {
+		log.Debug().Msg("no assignment rule matched")
+		return
+	}
+	log = log.With().Int("rule", i).Any("info", info).Logger()
+	log.Info().Msg("assignment rule matched")
+
+	// The team is assigned first, so that an explicitly configured agent
+	// takes precedence over the automatic assignment within the team.
+	if rule.TeamID != 0 {
+		if err := chatwootAPI.AssignTeam(ctx, conversationID, rule.TeamID); err != nil {
+			log.Err(err).Int("team_id", int(rule.TeamID)).Msg("failed to assign team")
+		}
+	}
+	if rule.AssigneeID != 0 {
+		if err := chatwootAPI.AssignAgent(ctx, conversationID, rule.AssigneeID); err != nil {
+			log.Err(err).Int("assignee_id", int(rule.AssigneeID)).Msg("failed to assign agent")
+		}
+	}
+	if rule.Priority != chatwootapi.ConversationPriorityNone {
+		if err := chatwootAPI.SetConversationPriority(ctx, conversationID, rule.Priority); err != nil {
+			log.Err(err).Str("priority", string(rule.Priority)).Msg("failed to set priority")
+		}
+	}
+}
+
+// findAssignmentRule returns the first rule that matches the conversation and
+// its index, or nil if no rule matches.
+func findAssignmentRule(rules []*assignmentRule, info *conversationInfo) (int, *assignmentRule) {
+	for i, rule := range rules {
+		if rule.Matches(info) {
+			return i, rule
+		}
+	}
+	return -1, nil
+}
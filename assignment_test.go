@@ -0,0 +1,191 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// testRoom builds the state of a room with the given name, bridge protocol
+// and joined members.
+func testRoom(name, protocolID, protocolName string, members ...id.UserID) mautrix.RoomStateMap {
+	state := mautrix.RoomStateMap{}
+	if name != "" {
+		state[event.StateRoomName] = map[string]*event.Event{
+			"": {Content: event.Content{Parsed: &event.RoomNameEventContent{Name: name}}},
+		}
+	}
+	if protocolID != "" {
+		state[event.StateBridge] = map[string]*event.Event{
+			"bridge": {Content: event.Content{Parsed: &event.BridgeEventContent{
+				Protocol: event.BridgeInfoSection{ID: protocolID, DisplayName: protocolName},
+			}}},
+		}
+	}
+	state[event.StateMember] = map[string]*event.Event{}
+	for _, member := range members {
+		state[event.StateMember][member.String()] = &event.Event{
+			Content: event.Content{Parsed: &event.MemberEventContent{Membership: event.MembershipJoin}},
+		}
+	}
+	return state
+}
+
+// testMessage builds a message with the Beeper client metadata.
+func testMessage(sender id.UserID, body, clientType, language string) *event.Event {
+	raw := map[string]any{"msgtype": "m.text", "body": body}
+	if clientType != "" {
+		raw["com.beeper.origin_client_type"] = clientType
+	}
+	if language != "" {
+		raw["com.beeper.origin_client_language"] = language
+	}
+	return &event.Event{
+		Type:    event.EventMessage,
+		Sender:  sender,
+		Content: event.Content{Raw: raw, Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: body}},
+	}
+}
+
+func TestGetConversationInfo(t *testing.T) {
+	alice := id.UserID("@whatsapp_123:beeper.local")
+	state := testRoom("Alice", "whatsapp", "WhatsApp", alice, "@help:example.com")
+	state[event.StateMember]["@bob:example.com"] = &event.Event{
+		Content: event.Content{Parsed: &event.MemberEventContent{Membership: event.MembershipLeave}},
+	}
+	state[event.StateHalfShotBridge] = map[string]*event.Event{
+		"legacy": {Content: event.Content{Parsed: &event.BridgeEventContent{
+			Protocol: event.BridgeInfoSection{ID: "whatsapp-legacy"},
+		}}},
+	}
+
+	info := getConversationInfo(alice, state, testMessage(alice, "hi", "ios", "de_AT"))
+
+	if info.Homeserver != "beeper.local" {
+		t.Errorf("homeserver = %q, expected beeper.local", info.Homeserver)
+	}
+	if info.RoomName != "Alice" {
+		t.Errorf("room name = %q, expected Alice", info.RoomName)
+	}
+	if info.MemberCount != 2 {
+		t.Errorf("member count = %d, expected 2 (members that left don't count)", info.MemberCount)
+	}
+	networks := slices.Sorted(slices.Values(info.Networks))
+	if expected := []string{"WhatsApp", "whatsapp", "whatsapp-legacy"}; !slices.Equal(networks, expected) {
+		t.Errorf("networks = %q, expected %q", networks, expected)
+	}
+	if info.ClientType != "ios" || info.Language != "de_AT" {
+		t.Errorf("client type and language = %q, %q, expected ios, de_AT", info.ClientType, info.Language)
+	}
+
+	// Without the message, there is no client metadata.
+	if info := getConversationInfo(alice, state, nil); info.ClientType != "" || info.Language != "" {
+		t.Errorf("got client metadata %q, %q without a message", info.ClientType, info.Language)
+	}
+}
+
+func TestFindAssignmentRule(t *testing.T) {
+	rules, err := NewAssignmentRules([]AssignmentRule{
+		{RoomName: "^VIP", TeamID: 1, Priority: chatwootapi.ConversationPriorityUrgent},
+		{Network: "whatsapp", Language: "de", TeamID: 2},
+		{Network: "WhatsApp", TeamID: 3},
+		{Homeserver: "beeper.com", ClientType: "ios", AssigneeID: 7},
+	})
+	if err != nil {
+		t.Fatalf("NewAssignmentRules: %v", err)
+	}
+
+	whatsappUser := id.UserID("@whatsapp_123:beeper.local")
+	beeperUser := id.UserID("@alice:beeper.com")
+	tests := []struct {
+		name     string
+		contact  id.UserID
+		state    mautrix.RoomStateMap
+		message  *event.Event
+		wantRule int
+	}{
+		{
+			name:     "VIP room takes precedence over the network",
+			contact:  whatsappUser,
+			state:    testRoom("VIP: Alice", "whatsapp", "WhatsApp", whatsappUser),
+			message:  testMessage(whatsappUser, "hi", "", "de"),
+			wantRule: 0,
+		},
+		{
+			name:     "Austrian German customer goes to the German team",
+			contact:  whatsappUser,
+			state:    testRoom("Alice", "whatsapp", "WhatsApp", whatsappUser),
+			message:  testMessage(whatsappUser, "Servus", "", "de-AT"),
+			wantRule: 1,
+		},
+		{
+			name:     "other WhatsApp customers go to the WhatsApp team",
+			contact:  whatsappUser,
+			state:    testRoom("Alice", "whatsapp", "WhatsApp", whatsappUser),
+			message:  testMessage(whatsappUser, "hello", "", "en-US"),
+			wantRule: 2,
+		},
+		{
+			name:     "Beeper customer on iOS",
+			contact:  beeperUser,
+			state:    testRoom("", "", "", beeperUser),
+			message:  testMessage(beeperUser, "hello", "IOS", ""),
+			wantRule: 3,
+		},
+		{
+			name:     "Beeper customer on Android",
+			contact:  beeperUser,
+			state:    testRoom("", "", "", beeperUser),
+			message:  testMessage(beeperUser, "hello", "android", ""),
+			wantRule: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := getConversationInfo(tt.contact, tt.state, tt.message)
+			i, rule := findAssignmentRule(rules, info)
+			if i != tt.wantRule {
+				t.Fatalf("rule %d matched, expected %d", i, tt.wantRule)
+			} else if (rule == nil) != (tt.wantRule == -1) {
+				t.Fatalf("returned rule %v for index %d", rule, i)
+			}
+		})
+	}
+}
+
+func TestMatchesLanguage(t *testing.T) {
+	for _, tag := range []string{"de", "DE", "de-AT", "de_AT", "de-CH-1901"} {
+		if !matchesLanguage(tag, "de") {
+			t.Errorf("%q doesn't match de", tag)
+		}
+	}
+	for _, tag := range []string{"", "d", "deu", "dex-AT", "en-DE"} {
+		if matchesLanguage(tag, "de") {
+			t.Errorf("%q matches de", tag)
+		}
+	}
+	// A regional rule doesn't match the plain language or other regions.
+	if matchesLanguage("de", "de-AT") || matchesLanguage("de-CH", "de-AT") {
+		t.Errorf("de-AT matches another variant of de")
+	}
+	if !matchesLanguage("de_at", "de-AT") {
+		t.Errorf("de_at doesn't match de-AT")
+	}
+}
+
+func TestNewAssignmentRulesRejectsRulesWithoutActions(t *testing.T) {
+	for _, rule := range []AssignmentRule{
+		{Network: "whatsapp"},
+		{Network: "whatsapp", Priority: "critical"},
+		{RoomName: "(", TeamID: 1},
+	} {
+		if _, err := NewAssignmentRules([]AssignmentRule{rule}); err == nil {
+			t.Errorf("rule %+v was accepted", rule)
+		}
+	}
+}
@@ -15,7 +15,6 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"sync"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
@@ -37,7 +36,7 @@ func SendMessage(ctx context.Context, roomID id.RoomID, content *event.MessageEv
 		wrappedContent.Raw = extraContent[0]
 	}
 
-	r, err := DoRetry(ctx, "send message to "+roomID.String(), func(ctx context.Context) (*mautrix.RespSendEvent, error) {
+	r, err := DoRetry(ctx, RetryMatrixSend, "send message to "+roomID.String(), func(ctx context.Context) (*mautrix.RespSendEvent, error) {
 		return client.SendMessageEvent(ctx, roomID, event.EventMessage, &wrappedContent)
 	})
 	if err != nil {
@@ -74,19 +73,55 @@ func HandleWebhook(_ http.ResponseWriter, r *http.Request) {
 				break
 			}
 			conversationID := mc.Conversation.ID
-			err = HandleMessageCreated(ctx, mc)
+			handleMessageCreated := func() {
+				err := HandleMessageCreated(ctx, mc)
+				if err != nil {
+					DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send private error message to %d for %+v", conversationID, err), func(ctx context.Context) (*chatwootapi.Message, error) {
+						return chatwootAPI.SendPrivateMessage(
+							ctx,
+							conversationID,
+							fmt.Sprintf("**Error occurred while handling Chatwoot message. The message may not have been sent to Matrix!**\n\nError: %+v", err))
+					})
+				}
+			}
+
+			// Queue the message behind the other events in the room, so that
+			// it doesn't race with the Matrix handler. If there is no room
+			// yet, it will be created by the start new chat endpoint.
+			roomID, _, err := stateStore.GetMatrixRoomFromChatwootConversation(ctx, conversationID)
+			if err != nil {
+				handleMessageCreated()
+			} else {
+				roomQueue.Enqueue(roomID, handleMessageCreated)
+			}
+		case "conversation_status_changed":
+			var csc chatwootapi.ConversationStatusChanged
+			err = json.Unmarshal(webhookBody, &csc)
+			if err != nil {
+				log.Err(err).Msg("error decoding conversation status changed webhook body")
+				break
+			}
+			roomID, _, err := stateStore.GetMatrixRoomFromChatwootConversation(ctx, csc.ID)
 			if err != nil {
-				DoRetry(ctx, fmt.Sprintf("send private error message to %d for %+v", conversationID, err), func(ctx context.Context) (*chatwootapi.Message, error) {
-					return chatwootAPI.SendPrivateMessage(
-						ctx,
-						conversationID,
-						fmt.Sprintf("**Error occurred while handling Chatwoot message. The message may not have been sent to Matrix!**\n\nError: %+v", err))
-				})
+				break
 			}
+			roomQueue.Enqueue(roomID, func() { HandleConversationStatusChanged(ctx, csc) })
 		}
 	}
 }
 
+// HandleConversationStatusChanged clears the CSAT survey of a conversation
+// when it is reopened, so that the customer's new messages are not taken as
+// answers to the survey of the previous request.
+func HandleConversationStatusChanged(ctx context.Context, csc chatwootapi.ConversationStatusChanged) {
+	if csc.Status != chatwootapi.ConversationStatusOpen {
+		return
+	}
+	if err := stateStore.ClearCSATSurveyForConversation(ctx, csc.ID); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Int("conversation_id", int(csc.ID)).Msg("failed to clear CSAT survey of reopened conversation")
+	}
+}
+
 func handleAttachment(ctx context.Context, roomID id.RoomID, chatwootMessageID chatwootapi.MessageID, chatwootAttachment chatwootapi.Attachment) (*mautrix.RespSendEvent, error) {
 	log := zerolog.Ctx(ctx).With().
 		Str("func", "handleAttachment").
@@ -96,7 +131,7 @@ func handleAttachment(ctx context.Context, roomID id.RoomID, chatwootMessageID c
 	ctx = log.WithContext(ctx)
 
 	// Download the attachment
-	attachmentData, err := DoRetryArr(ctx, fmt.Sprintf("Download attachment: %s", chatwootAttachment.DataURL), func(ctx context.Context) ([]byte, error) {
+	attachmentData, err := DoRetryArr(ctx, RetryMediaDownload, fmt.Sprintf("Download attachment: %s", chatwootAttachment.DataURL), func(ctx context.Context) ([]byte, error) {
 		return chatwootAPI.DownloadAttachment(ctx, chatwootAttachment.DataURL)
 	})
 	if err != nil {
@@ -130,7 +165,7 @@ func handleAttachment(ctx context.Context, roomID id.RoomID, chatwootMessageID c
 	// Handle the thumbnail if it exists.
 	if len(chatwootAttachment.ThumbURL) > 0 {
 		// Download the thumbnail
-		thumbnailData, err := DoRetryArr(ctx, fmt.Sprintf("Download attachment thumbnail: %s", chatwootAttachment.ThumbURL), func(ctx context.Context) ([]byte, error) {
+		thumbnailData, err := DoRetryArr(ctx, RetryMediaDownload, fmt.Sprintf("Download attachment thumbnail: %s", chatwootAttachment.ThumbURL), func(ctx context.Context) ([]byte, error) {
 			return chatwootAPI.DownloadAttachment(ctx, chatwootAttachment.ThumbURL)
 		})
 		if err != nil {
@@ -161,7 +196,7 @@ func handleAttachment(ctx context.Context, roomID id.RoomID, chatwootMessageID c
 		info.ThumbnailFile.EncryptInPlace(thumbnailData)
 
 		// Upload the thumbnail
-		uploadedThumbnail, err := DoRetry(ctx, "upload thumbnail to Matrix", func(ctx context.Context) (*mautrix.RespMediaUpload, error) {
+		uploadedThumbnail, err := DoRetry(ctx, RetryMatrixSend, "upload thumbnail to Matrix", func(ctx context.Context) (*mautrix.RespMediaUpload, error) {
 			return client.UploadMedia(ctx, mautrix.ReqUploadMedia{
 				ContentBytes:  thumbnailData,
 				ContentLength: int64(len(thumbnailData)),
@@ -197,7 +232,7 @@ func handleAttachment(ctx context.Context, roomID id.RoomID, chatwootMessageID c
 	}
 
 	// Upload it to the media repo
-	uploaded, err := DoRetry(ctx, fmt.Sprintf("upload %s to Matrix", filename), func(ctx context.Context) (*mautrix.RespMediaUpload, error) {
+	uploaded, err := DoRetry(ctx, RetryMatrixSend, fmt.Sprintf("upload %s to Matrix", filename), func(ctx context.Context) (*mautrix.RespMediaUpload, error) {
 		return client.UploadMedia(ctx, mautrix.ReqUploadMedia{
 			ContentBytes:  attachmentData,
 			ContentLength: int64(len(attachmentData)),
@@ -243,8 +278,9 @@ func HandleMessageCreated(ctx context.Context, mc chatwootapi.MessageCreated) er
 		Int("conversation_id", int(mc.Conversation.ID)).Logger()
 	ctx = log.WithContext(ctx)
 
-	// Skip private messages
+	// Skip private messages, unless they are agent commands
 	if mc.Private {
+		HandleMergeContactCommand(ctx, mc)
 		return nil
 	}
 
@@ -316,17 +352,6 @@ func HandleMessageCreated(ctx context.Context, mc chatwootapi.MessageCreated) er
 	log = log.With().Stringer("room_id", roomID).Logger()
 	ctx = log.WithContext(ctx)
 
-	// Acquire the lock, so that we don't have race conditions with the matrix
-	// handler.
-	if _, found := roomSendlocks[roomID]; !found {
-		log.Debug().Msg("creating send lock")
-		roomSendlocks[roomID] = &sync.Mutex{}
-	}
-	roomSendlocks[roomID].Lock()
-	log.Debug().Msg("acquired send lock")
-	defer log.Debug().Msg("released send lock")
-	defer roomSendlocks[roomID].Unlock()
-
 	eventIDs := stateStore.GetMatrixEventIDsForChatwootMessage(ctx, mc.ID)
 
 	// Handle deletions first.
@@ -334,6 +359,8 @@ func HandleMessageCreated(ctx context.Context, mc chatwootapi.MessageCreated) er
 		log.Info().Int("message_id", int(mc.ID)).Msg("message deleted")
 		var errs []error
 		for _, eventID := range eventIDs {
+			// The message may have been sent before the room was upgraded.
+			roomID := findEventRoom(ctx, mc.Conversation.ID, roomID, eventID)
 			event, err := client.GetEvent(ctx, roomID, eventID)
 			if err == nil && event.Unsigned.RedactedBecause != nil {
 				// Already redacted
@@ -364,10 +391,30 @@ func HandleMessageCreated(ctx context.Context, mc chatwootapi.MessageCreated) er
 	var resp *mautrix.RespSendEvent
 
 	message := mc.Conversation.Messages[0]
+	senderName := strings.Split(message.Sender.AvailableName, " ")[0]
 
-	if message.Content != nil {
+	if mc.ContentType == chatwootapi.ContentTypeInputCSAT {
+		resp, err = sendCSATSurvey(ctx, roomID, mc, senderName)
+		if err != nil {
+			return err
+		}
+		stateStore.SetChatwootMessageIDForMatrixEvent(ctx, resp.EventID, mc.ID)
+	} else if isInteractiveContentType(mc.ContentType) {
+		messageEventContent, options := renderInteractiveMessage(mc, senderName)
+		resp, err = SendMessage(ctx, roomID, messageEventContent, map[string]any{
+			"com.beeper.chatwoot.message_id":   mc.ID,
+			"com.beeper.chatwoot.content_type": mc.ContentType,
+		})
+		if err != nil {
+			return err
+		}
+		stateStore.SetChatwootMessageIDForMatrixEvent(ctx, resp.EventID, mc.ID)
+		if len(options) > 0 {
+			setPendingInput(ctx, roomID, mc, options)
+		}
+	} else if message.Content != nil {
 		var messageEventContent event.MessageEventContent
-		messageText := fmt.Sprintf("%s - %s", *message.Content, strings.Split(message.Sender.AvailableName, " ")[0])
+		messageText := fmt.Sprintf("%s - %s", *message.Content, senderName)
 		if configuration.RenderMarkdown {
 			messageEventContent = format.RenderMarkdown(messageText, true, true)
 		} else {
@@ -380,10 +427,21 @@ func HandleMessageCreated(ctx context.Context, mc chatwootapi.MessageCreated) er
 			return err
 		}
 		stateStore.SetChatwootMessageIDForMatrixEvent(ctx, resp.EventID, mc.ID)
+
+		if mc.MessageType == string(chatwootapi.OutgoingMessage) {
+			applyLinkRules(ctx, mc.Conversation.ID, *message.Content, true)
+		}
 	}
 
 	for _, a := range message.Attachments {
-		resp, err = handleAttachment(ctx, roomID, mc.ID, a)
+		switch a.FileType {
+		case "location":
+			resp, err = sendLocationAttachment(ctx, roomID, mc.ID, a)
+		case "contact":
+			resp, err = sendContactAttachment(ctx, roomID, mc.ID, a)
+		default:
+			resp, err = handleAttachment(ctx, roomID, mc.ID, a)
+		}
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+	"github.com/beeper/chatwoot/database"
+)
+
+// isInteractiveContentType returns whether the given Chatwoot content type
+// needs to be rendered specially when bridging to Matrix.
+func isInteractiveContentType(contentType chatwootapi.ContentType) bool {
+	switch contentType {
+	case chatwootapi.ContentTypeInputSelect,
+		chatwootapi.ContentTypeCards,
+		chatwootapi.ContentTypeForm,
+		chatwootapi.ContentTypeArticle,
+		chatwootapi.ContentTypeInputCSAT:
+		return true
+	default:
+		return false
+	}
+}
+
+// interactiveMessageBuilder builds the plaintext and HTML bodies of a Matrix
+// message in parallel.
+type interactiveMessageBuilder struct {
+	body strings.Builder
+	html strings.Builder
+}
+
+func (b *interactiveMessageBuilder) paragraph(text string) {
+	b.rawParagraph(text, strings.ReplaceAll(html.EscapeString(text), "\n", "<br>"))
+}
+
+// rawParagraph writes a paragraph whose HTML representation is already
+// escaped.
+func (b *interactiveMessageBuilder) rawParagraph(text, formatted string) {
+	if text == "" {
+		return
+	}
+	if b.body.Len() > 0 {
+		b.body.WriteString("\n\n")
+	}
+	b.body.WriteString(text)
+	fmt.Fprintf(&b.html, "<p>%s</p>", formatted)
+}
+
+func (b *interactiveMessageBuilder) hint(text string) {
+	if b.body.Len() > 0 {
+		b.body.WriteString("\n\n")
+	}
+	fmt.Fprintf(&b.body, "_%s_", text)
+	fmt.Fprintf(&b.html, "<p><em>%s</em></p>", html.EscapeString(text))
+}
+
+// list writes a list where every item has a plaintext and an HTML
+// representation. The HTML representation must already be escaped.
+func (b *interactiveMessageBuilder) list(ordered bool, plainItems, htmlItems []string) {
+	if len(plainItems) == 0 {
+		return
+	}
+	if b.body.Len() > 0 {
+		b.body.WriteString("\n\n")
+	}
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	fmt.Fprintf(&b.html, "<%s>", tag)
+	for i, item := range plainItems {
+		if i > 0 {
+			b.body.WriteString("\n")
+		}
+		if ordered {
+			fmt.Fprintf(&b.body, "%d. %s", i+1, item)
+		} else {
+			fmt.Fprintf(&b.body, "- %s", item)
+		}
+		fmt.Fprintf(&b.html, "<li>%s</li>", htmlItems[i])
+	}
+	fmt.Fprintf(&b.html, "</%s>", tag)
+}
+
+func (b *interactiveMessageBuilder) content() *event.MessageEventContent {
+	return &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          b.body.String(),
+		Format:        event.FormatHTML,
+		FormattedBody: b.html.String(),
+	}
+}
+
+func htmlLink(url, text string) string {
+	return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(url), html.EscapeString(text))
+}
+
+// renderInteractiveMessage converts an interactive Chatwoot message into a
+// Matrix message. If the customer can answer the message by replying with a
+// number, the options that the numbers map to are returned as well.
+func renderInteractiveMessage(mc chatwootapi.MessageCreated, senderName string) (*event.MessageEventContent, []chatwootapi.SubmittedValue) {
+	var b interactiveMessageBuilder
+	var options []chatwootapi.SubmittedValue
+	var items []chatwootapi.ContentItem
+	if mc.ContentAttributes != nil {
+		items = mc.ContentAttributes.Items
+	}
+
+	if mc.Content != "" {
+		b.paragraph(fmt.Sprintf("%s - %s", mc.Content, senderName))
+	} else {
+		b.paragraph(fmt.Sprintf("Message from %s", senderName))
+	}
+
+	switch mc.ContentType {
+	case chatwootapi.ContentTypeInputSelect:
+		var plainItems, htmlItems []string
+		for _, item := range items {
+			plainItems = append(plainItems, item.Title)
+			htmlItems = append(htmlItems, html.EscapeString(item.Title))
+			options = append(options, chatwootapi.SubmittedValue{Title: item.Title, Value: item.Value})
+		}
+		b.list(true, plainItems, htmlItems)
+		if len(options) > 0 {
+			b.hint("Reply with the number of your choice.")
+		}
+
+	case chatwootapi.ContentTypeCards:
+		for _, item := range items {
+			var plainCard []string
+			var htmlCard []string
+			if item.Title != "" {
+				plainCard = append(plainCard, item.Title)
+				htmlCard = append(htmlCard, fmt.Sprintf("<strong>%s</strong>", html.EscapeString(item.Title)))
+			}
+			if item.Description != "" {
+				plainCard = append(plainCard, item.Description)
+				htmlCard = append(htmlCard, html.EscapeString(item.Description))
+			}
+			if item.MediaURL != "" {
+				plainCard = append(plainCard, item.MediaURL)
+				htmlCard = append(htmlCard, htmlLink(item.MediaURL, item.MediaURL))
+			}
+			b.rawParagraph(strings.Join(plainCard, "\n"), strings.Join(htmlCard, "<br>"))
+
+			var plainActions, htmlActions []string
+			for _, action := range item.Actions {
+				if action.Type == "link" && action.URI != "" {
+					plainActions = append(plainActions, fmt.Sprintf("%s: %s", action.Text, action.URI))
+					htmlActions = append(htmlActions, htmlLink(action.URI, action.Text))
+				} else {
+					options = append(options, chatwootapi.SubmittedValue{Title: action.Text, Value: action.Payload})
+					plainActions = append(plainActions, fmt.Sprintf("%d: %s", len(options), action.Text))
+					htmlActions = append(htmlActions, fmt.Sprintf("%d: %s", len(options), html.EscapeString(action.Text)))
+				}
+			}
+			b.list(false, plainActions, htmlActions)
+		}
+		if len(options) > 0 {
+			b.hint("Reply with the number of your choice.")
+		}
+
+	case chatwootapi.ContentTypeForm:
+		var plainItems, htmlItems []string
+		for _, item := range items {
+			label := item.Label
+			if label == "" {
+				label = item.Name
+			}
+			plain := label
+			formatted := html.EscapeString(label)
+			if item.Placeholder != "" {
+				plain += fmt.Sprintf(" (%s)", item.Placeholder)
+				formatted += fmt.Sprintf(" <em>(%s)</em>", html.EscapeString(item.Placeholder))
+			}
+			if len(item.Options) > 0 {
+				var optionLabels []string
+				for _, option := range item.Options {
+					optionLabels = append(optionLabels, option.Label)
+				}
+				plain += ": " + strings.Join(optionLabels, ", ")
+				formatted += ": " + html.EscapeString(strings.Join(optionLabels, ", "))
+			}
+			plainItems = append(plainItems, plain)
+			htmlItems = append(htmlItems, formatted)
+		}
+		b.list(true, plainItems, htmlItems)
+
+	case chatwootapi.ContentTypeArticle:
+		var plainItems, htmlItems []string
+		for _, item := range items {
+			plain := item.Title
+			formatted := html.EscapeString(item.Title)
+			if item.Link != "" {
+				plain += ": " + item.Link
+				formatted = htmlLink(item.Link, item.Title)
+			}
+			if item.Description != "" {
+				plain += fmt.Sprintf(" (%s)", item.Description)
+				formatted += "<br>" + html.EscapeString(item.Description)
+			}
+			plainItems = append(plainItems, plain)
+			htmlItems = append(htmlItems, formatted)
+		}
+		b.list(false, plainItems, htmlItems)
+
+	case chatwootapi.ContentTypeInputCSAT:
+		var plainItems, htmlItems []string
+		for i, emoji := range csatRatingEmojis {
+			plainItems = append(plainItems, fmt.Sprintf("%s %d", emoji, i+1))
+			htmlItems = append(htmlItems, fmt.Sprintf("%s %d", emoji, i+1))
+		}
+		b.list(false, plainItems, htmlItems)
+		b.hint("React with one of the emojis or reply with a number from 1 (very unsatisfied) to 5 (very satisfied).")
+	}
+
+	return b.content(), options
+}
+
+// replayedEventKey marks a context that handles a message that is replayed
+// (from the room history, or after it was decrypted late) rather than just
+// received.
+type replayedEventKey struct{}
+
+// withReplayedEvent marks the context as handling a replayed message.
+func withReplayedEvent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replayedEventKey{}, true)
+}
+
+func isReplayedEvent(ctx context.Context) bool {
+	replayed, _ := ctx.Value(replayedEventKey{}).(bool)
+	return replayed
+}
+
+// pendingInputWindow is how long after an interactive message was sent a
+// number from the customer is treated as an answer to it.
+const pendingInputWindow = 1 * time.Hour
+
+// handleInteractiveReply checks whether the given message body is a numeric
+// answer to the pending interactive message in the room. If it is, the
+// submitted value is sent to Chatwoot and the message is returned. If the body
+// is not an answer, nil is returned. Only the next message after the
+// interactive message can answer it, and only within the pendingInputWindow.
+// Replayed messages are older than the interactive message, so they are never
+// answers.
+func handleInteractiveReply(ctx context.Context, roomID id.RoomID, conversationID chatwootapi.ConversationID, body string) (*chatwootapi.Message, error) {
+	if isReplayedEvent(ctx) {
+		return nil, nil
+	}
+	log := zerolog.Ctx(ctx).With().Str("component", "handle_interactive_reply").Logger()
+	ctx = log.WithContext(ctx)
+
+	pendingInput, err := stateStore.GetPendingInputForRoom(ctx, roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		log.Warn().Err(err).Msg("failed to get pending input for room")
+		return nil, nil
+	}
+
+	choice, err := strconv.Atoi(strings.TrimSpace(body))
+	if err != nil || choice < 1 || choice > len(pendingInput.Options) || time.Since(pendingInput.CreatedAt) > pendingInputWindow {
+		// The customer didn't answer or the answer is too late, so later
+		// numbers are not answers either.
+		if err = stateStore.ClearPendingInputForRoom(ctx, roomID); err != nil {
+			log.Warn().Err(err).Msg("failed to clear pending input for room")
+		}
+		return nil, nil
+	}
+	submitted := pendingInput.Options[choice-1]
+	log.Info().
+		Int("pending_message_id", int(pendingInput.ChatwootMessageID)).
+		Int("choice", choice).
+		Msg("mapping numeric reply to submitted value")
+
+	cm, err := chatwootAPI.SendSubmittedValuesMessage(ctx, conversationID, submitted.Title, []chatwootapi.SubmittedValue{submitted})
+	if err != nil {
+		return nil, err
+	}
+	if err = stateStore.ClearPendingInputForRoom(ctx, roomID); err != nil {
+		log.Warn().Err(err).Msg("failed to clear pending input for room")
+	}
+	return cm, nil
+}
+
+// setPendingInput records that the customer can answer the given Chatwoot
+// message by replying with a number.
+func setPendingInput(ctx context.Context, roomID id.RoomID, mc chatwootapi.MessageCreated, options []chatwootapi.SubmittedValue) {
+	err := stateStore.SetPendingInputForRoom(ctx, roomID, database.PendingInput{
+		ChatwootMessageID: mc.ID,
+		ContentType:       mc.ContentType,
+		Options:           options,
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to set pending input for room")
+	}
+}
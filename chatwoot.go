@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -34,8 +35,6 @@ var stateStore *database.Database
 
 var chatwootAPI *chatwootapi.ChatwootAPI
 
-var roomSendlocks map[id.RoomID]*sync.Mutex
-
 var chatwootConversationIDType = event.Type{
 	Type:  "com.beeper.chatwoot.conversation_id",
 	Class: event.StateEventType,
@@ -50,6 +49,8 @@ var VERSION = "0.2.1"
 func main() {
 	// Arg parsing
 	configPath := flag.String("config", "./config.yaml", "config file location")
+	migratePickleKeyFlag := flag.Bool("migrate-pickle-key", false, "re-encrypt the crypto store with the configured pickle key and exit")
+	oldPickleKeyFile := flag.String("old-pickle-key-file", "", "file containing the pickle key that the crypto store is currently encrypted with (defaults to the legacy key)")
 	flag.Parse()
 
 	// Load configuration
@@ -64,12 +65,52 @@ func main() {
 		HomeserverWhitelist:     HomeserverWhitelist{Enable: false},
 		StartNewChat:            StartNewChat{Enable: false},
 		ChatwootBaseUrl:         "https://app.chatwoot.com/",
+		ChatwootRateLimit:       ChatwootRateLimit{RequestsPerSecond: 10, Burst: 20},
 		ListenPort:              8080,
 		BridgeIfMembersLessThan: -1,
 		RenderMarkdown:          false,
+		MaxConcurrentRooms:      16,
+		RoomActivityNotes:       true,
+		ShutdownTimeout:         30 * time.Second,
+		DeviceTrust:             DeviceTrustConfiguration{Policy: DeviceTrustAllowAll},
+		ContactIdentifiers: ContactIdentifierConfiguration{
+			Builtin: DefaultBuiltinContactIdentifierResolvers,
+		},
+		CustomAttributes: []CustomAttributeMapping{
+			{Attribute: "reason"},
+			{Attribute: "category"},
+			{Attribute: "subcategory"},
+			{Attribute: "client"},
+			{Attribute: "network"},
+			{Attribute: "internal_note"},
+		},
+		LinkRules: []LinkRule{
+			{Pattern: `[A-Z]{1,5}-\d+`, URL: "https://linear.app/beeper/issue/${0}"},
+		},
+		LabelDelay: 30 * time.Second,
+		InvitePolicy: InvitePolicyConfiguration{
+			RateLimit: InviteRateLimit{MaxInvites: 5, Period: time.Hour},
+		},
+		RoomCleanup: RoomCleanupConfiguration{
+			Interval:            time.Hour,
+			LeaveIfCustomerLeft: true,
+		},
+		ContactEnrichment: ContactEnrichmentConfiguration{
+			Enable:          true,
+			RefreshInterval: 24 * time.Hour,
+		},
 		Backfill: BackfillConfiguration{
 			ChatwootConversations: true,
+			History: BackfillHistoryConfiguration{
+				MaxMessages: 50,
+			},
 		},
+		Retry: RetryConfiguration{
+			MatrixSend:    defaultRetryPolicy,
+			ChatwootSend:  defaultRetryPolicy,
+			MediaDownload: defaultRetryPolicy,
+		},
+		UndecryptableEventMaxAge: 7 * 24 * time.Hour,
 	}
 
 	err = yaml.Unmarshal(configYaml, &configuration)
@@ -83,6 +124,30 @@ func main() {
 		globallog.Fatal().Err(err).Msg("Failed to compile logging configuration")
 	}
 
+	if !configuration.DeviceTrust.Policy.IsValid() {
+		log.Fatal().Str("policy", string(configuration.DeviceTrust.Policy)).Msg("Invalid device trust policy")
+	}
+	contactIdentifierResolvers, err = NewContactIdentifierResolvers(configuration.ContactIdentifiers)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid contact identifier configuration")
+	}
+	assignmentRules, err = NewAssignmentRules(configuration.AssignmentRules)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid assignment rules")
+	}
+	customAttributeMappings, err = NewCustomAttributeMappings(configuration.CustomAttributes)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid custom attribute mapping")
+	}
+	linkRules, err = NewLinkRules(configuration.LinkRules)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid link rules")
+	}
+	labelRules, err = NewLabelRules(configuration.LabelRules, configuration.CanonicalDMPrefix)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid label rules")
+	}
+
 	getLogger := func(evt *event.Event) zerolog.Logger {
 		return log.With().
 			Stringer("event_type", &evt.Type).
@@ -102,14 +167,38 @@ func main() {
 		log.Fatal().Err(err).Msg("couldn't open database")
 	}
 
-	// Initialize the send lock map
-	roomSendlocks = map[id.RoomID]*sync.Mutex{}
+	// Initialize the room queue
+	roomQueue = NewRoomQueue(configuration.MaxConcurrentRooms)
 
 	stateStore = database.NewDatabase(db)
 	if err := stateStore.DB.Upgrade(ctx); err != nil {
 		log.Fatal().Err(err).Msg("failed to upgrade the Chatwoot database")
 	}
 
+	pickleKey, err := configuration.GetPickleKey(log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not read pickle key")
+	} else if string(pickleKey) == LegacyPickleKey {
+		log.Warn().Msg("Using the legacy pickle key for the crypto store. Set pickle_key_file or pickle_key_env in config to use a secret key.")
+	}
+
+	if *migratePickleKeyFlag {
+		oldPickleKey := []byte(LegacyPickleKey)
+		if *oldPickleKeyFile != "" {
+			buf, err := os.ReadFile(*oldPickleKeyFile)
+			if err != nil {
+				log.Fatal().Err(err).Str("old_pickle_key_file", *oldPickleKeyFile).Msg("Could not read old pickle key")
+			}
+			oldPickleKey = []byte(strings.TrimSpace(string(buf)))
+		}
+		err = migratePickleKey(ctx, db, configuration.Username.String(), oldPickleKey, pickleKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to migrate pickle key")
+		}
+		log.Info().Msg("Successfully migrated the crypto store to the new pickle key")
+		os.Exit(0)
+	}
+
 	client, err = mautrix.NewClient(configuration.Homeserver, "", "")
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create matrix client")
@@ -127,8 +216,11 @@ func main() {
 		configuration.ChatwootInboxID,
 		accessToken,
 	)
+	if configuration.ChatwootRateLimit.RequestsPerSecond > 0 {
+		chatwootAPI.RateLimiter = chatwootapi.NewRateLimiter(configuration.ChatwootRateLimit.RequestsPerSecond, configuration.ChatwootRateLimit.Burst)
+	}
 
-	cryptoHelper, err := cryptohelper.NewCryptoHelper(client, []byte("chatwoot_cryptostore_key"), db)
+	cryptoHelper, err := cryptohelper.NewCryptoHelper(client, pickleKey, db)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create crypto helper")
 	}
@@ -147,22 +239,41 @@ func main() {
 		ctx := log.WithContext(context.TODO())
 		log.Error().Err(decryptErr).Msg("Failed to decrypt message")
 
+		// Try to fetch the missing session from the key backup before
+		// declaring the message lost.
+		if keyBackup != nil && errors.Is(decryptErr, crypto.ErrNoSessionFound) {
+			decrypted, err := keyBackup.DecryptWithBackup(ctx, evt)
+			if err == nil {
+				log.Info().Msg("Decrypted message using session from key backup")
+				decrypted.Mautrix.EventSource |= event.SourceDecrypted
+				client.Syncer.(mautrix.DispatchableSyncer).Dispatch(ctx, decrypted)
+				return
+			}
+			log.Warn().Err(err).Msg("Failed to decrypt message using key backup")
+		}
+
 		stateStore.UpdateMostRecentEventIDForRoom(ctx, evt.RoomID, evt.ID)
 		if !VerifyFromAuthorizedUser(ctx, evt.Sender) {
 			return
 		}
 
+		// Keep the event around so that it can be bridged if the session
+		// arrives later.
+		if err := queueUndecryptableEvent(ctx, evt); err != nil {
+			log.Err(err).Msg("Failed to queue undecryptable event")
+		}
+
 		conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, evt.RoomID)
 		if err != nil {
 			log.Warn().Err(err).Msg("no Chatwoot conversation associated with this room")
 			return
 		}
 
-		DoRetry(ctx, fmt.Sprintf("send private error message to %d for %+v", conversationID, decryptErr), func(ctx context.Context) (*chatwootapi.Message, error) {
+		DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send private error message to %d for %+v", conversationID, decryptErr), func(ctx context.Context) (*chatwootapi.Message, error) {
 			return chatwootAPI.SendPrivateMessage(
 				ctx,
 				conversationID,
-				fmt.Sprintf("**Failed to decrypt Matrix event (%s). You probably missed a message!**\n\nError: %+v", evt.ID, decryptErr))
+				fmt.Sprintf("**Failed to decrypt Matrix event (%s). You probably missed a message!** It will be bridged automatically if the keys arrive later.\n\nError: %+v", evt.ID, decryptErr))
 		})
 	}
 
@@ -171,16 +282,22 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to initialize crypto helper")
 	}
 	cryptoHelper.Machine().AllowKeyShare = AllowKeyShare
+	cryptoHelper.Machine().SendKeysMinTrust = configuration.DeviceTrust.Policy.MinTrust()
+	cryptoHelper.Machine().SessionReceived = func(_ context.Context, roomID id.RoomID, sessionID id.SessionID, _ uint32) {
+		go retryUndecryptableEvents(ctx, roomID, sessionID)
+	}
+
+	recoveryKey, err := configuration.GetRecoveryKey(log)
+	if err != nil {
+		log.Error().Err(err).Str("recovery_key_file", configuration.RecoveryKeyFile).Msg("Could not read recovery key")
+	}
 
 	// Check if device is cross-signed and verify with recovery key if not
 	_, isVerified, err := cryptoHelper.Machine().GetOwnVerificationStatus(ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to check verification status")
 	} else if !isVerified {
-		recoveryKey, err := configuration.GetRecoveryKey(log)
-		if err != nil {
-			log.Error().Err(err).Str("recovery_key_file", configuration.RecoveryKeyFile).Msg("Could not read recovery key")
-		} else if recoveryKey == "" {
+		if recoveryKey == "" {
 			log.Error().Msg("Device is not verified and no recovery key file configured. Set recovery_key_file in config to enable cross-signing verification.")
 		} else {
 			err = cryptoHelper.Machine().VerifyWithRecoveryKey(ctx, recoveryKey)
@@ -194,104 +311,144 @@ func main() {
 		log.Info().Msg("Device is already verified")
 	}
 
+	if configuration.KeyBackup.Enable {
+		if recoveryKey == "" {
+			log.Error().Msg("Key backup is enabled but no recovery key file configured. Set recovery_key_file in config to use the key backup.")
+		} else {
+			keyBackup, err = SetupKeyBackup(ctx, cryptoHelper.Machine(), recoveryKey)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to set up key backup")
+			}
+		}
+	}
+
 	client.Crypto = cryptoHelper
 
 	addEvtContext := func(ctx context.Context, evt *event.Event) context.Context {
+		// The event is bridged asynchronously, so it shouldn't be cancelled
+		// when the sync loop stops. Queued events are drained on shutdown.
 		return zerolog.Ctx(ctx).With().
 			Stringer("event_type", &evt.Type).
 			Stringer("sender", evt.Sender).
 			Str("room_id", string(evt.RoomID)).
 			Str("event_id", string(evt.ID)).
 			Logger().
-			WithContext(ctx)
+			WithContext(context.WithoutCancel(ctx))
 	}
 	syncer := client.Syncer.(*mautrix.DefaultSyncer)
 	syncer.OnEventType(event.EventMessage, func(ctx context.Context, evt *event.Event) {
 		ctx = addEvtContext(ctx, evt)
 		stateStore.UpdateMostRecentEventIDForRoom(ctx, evt.RoomID, evt.ID)
-		if VerifyFromAuthorizedUser(ctx, evt.Sender) {
-			go HandleMessage(ctx, evt)
+		if VerifyFromAuthorizedUser(ctx, evt.Sender) && VerifyFromTrustedDevice(ctx, evt) {
+			roomQueue.Enqueue(evt.RoomID, func() { HandleMessage(ctx, evt) })
 		}
 	})
 	syncer.OnEventType(event.EventReaction, func(ctx context.Context, evt *event.Event) {
 		ctx = addEvtContext(ctx, evt)
 
 		stateStore.UpdateMostRecentEventIDForRoom(ctx, evt.RoomID, evt.ID)
-		if VerifyFromAuthorizedUser(ctx, evt.Sender) {
-			go HandleReaction(ctx, evt)
+		if VerifyFromAuthorizedUser(ctx, evt.Sender) && VerifyFromTrustedDevice(ctx, evt) {
+			roomQueue.Enqueue(evt.RoomID, func() { HandleReaction(ctx, evt) })
 		}
 	})
 	syncer.OnEventType(event.EventRedaction, func(ctx context.Context, evt *event.Event) {
 		ctx = addEvtContext(ctx, evt)
 
 		stateStore.UpdateMostRecentEventIDForRoom(ctx, evt.RoomID, evt.ID)
-		if VerifyFromAuthorizedUser(ctx, evt.Sender) {
-			go HandleRedaction(ctx, evt)
+		if VerifyFromAuthorizedUser(ctx, evt.Sender) && VerifyFromTrustedDevice(ctx, evt) {
+			roomQueue.Enqueue(evt.RoomID, func() { HandleRedaction(ctx, evt) })
 		}
 	})
 
-	syncCtx, cancelSync := context.WithCancel(context.Background())
-	var syncStopWait sync.WaitGroup
-	syncStopWait.Add(1)
+	syncer.OnEventType(event.EventUnstablePollStart, func(ctx context.Context, evt *event.Event) {
+		ctx = addEvtContext(ctx, evt)
 
-	// Start the sync loop
-	go func() {
-		log.Debug().Msg("starting sync loop")
-		err = client.SyncWithContext(syncCtx)
-		defer syncStopWait.Done()
-		if err != nil && !errors.Is(err, context.Canceled) {
-			log.Fatal().Err(err).Msg("Sync error")
+		stateStore.UpdateMostRecentEventIDForRoom(ctx, evt.RoomID, evt.ID)
+		if VerifyFromAuthorizedUser(ctx, evt.Sender) && VerifyFromTrustedDevice(ctx, evt) {
+			roomQueue.Enqueue(evt.RoomID, func() { HandlePollStart(ctx, evt) })
 		}
-	}()
+	})
+	syncer.OnEventType(event.EventUnstablePollResponse, func(ctx context.Context, evt *event.Event) {
+		ctx = addEvtContext(ctx, evt)
 
-	// Make sure that there are conversations for all of the rooms that the bot
-	// is in.
-	// This is run every 24 hours.
-	go func() {
-		if !configuration.Backfill.ChatwootConversations && !configuration.Backfill.ConversationIDStateEvents {
-			return
+		stateStore.UpdateMostRecentEventIDForRoom(ctx, evt.RoomID, evt.ID)
+		if VerifyFromAuthorizedUser(ctx, evt.Sender) && VerifyFromTrustedDevice(ctx, evt) {
+			roomQueue.Enqueue(evt.RoomID, func() { HandlePollResponse(ctx, evt) })
 		}
+	})
+	syncer.OnEventType(event.EventUnstablePollEnd, func(ctx context.Context, evt *event.Event) {
+		ctx = addEvtContext(ctx, evt)
 
-		for {
-			log := log.With().Str("component", "conversation_creation_backfill").Logger()
-			ctx := log.WithContext(context.Background())
-
-			log.Info().Msg("starting to create conversations for rooms that don't have a conversation yet")
+		stateStore.UpdateMostRecentEventIDForRoom(ctx, evt.RoomID, evt.ID)
+		if VerifyFromAuthorizedUser(ctx, evt.Sender) && VerifyFromTrustedDevice(ctx, evt) {
+			roomQueue.Enqueue(evt.RoomID, func() { HandlePollEnd(ctx, evt) })
+		}
+	})
 
-			joined, err := client.JoinedRooms(ctx)
-			if err != nil {
-				log.Fatal().Err(err).Msg("Failed to get joined rooms")
+	for _, evtType := range roomStateEventTypes {
+		syncer.OnEventType(evtType, func(ctx context.Context, evt *event.Event) {
+			// State events that are not in the timeline are the current state
+			// of the room (for example, after an initial or gappy sync)
+			// rather than changes.
+			if evt.Mautrix.EventSource&event.SourceTimeline == 0 {
+				return
 			}
+			ctx = addEvtContext(ctx, evt)
+			roomQueue.Enqueue(evt.RoomID, func() { HandleRoomStateChange(ctx, evt) })
+		})
+	}
+	syncer.OnEventType(event.StateMember, func(ctx context.Context, evt *event.Event) {
+		if !configuration.InvitePolicy.Enable || evt.Mautrix.EventSource&event.SourceInvite == 0 ||
+			evt.GetStateKey() != configuration.Username.String() || evt.Content.AsMember().Membership != event.MembershipInvite {
+			return
+		}
+		ctx = addEvtContext(ctx, evt)
+		roomQueue.Enqueue(evt.RoomID, func() { HandleInvite(ctx, evt) })
+	})
+	syncer.OnEventType(event.StateTombstone, func(ctx context.Context, evt *event.Event) {
+		ctx = addEvtContext(ctx, evt)
+		if VerifyFromAuthorizedUser(ctx, evt.Sender) {
+			roomQueue.Enqueue(evt.RoomID, func() { HandleTombstone(ctx, evt) })
+		}
+	})
 
-			for _, roomID := range joined.JoinedRooms {
-				chatwootConversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, roomID)
-				if err != nil {
-					// This room doesn't already has a Chatwoot conversation
-					// associtaed with it.
-					if configuration.Backfill.ChatwootConversations {
-						err = backfillConversationForRoom(ctx, roomID)
-						if err != nil {
-							log.Warn().Err(err).Msg("Failed to backfill conversation for room")
-							continue
-						}
-					}
-				} else if configuration.Backfill.ConversationIDStateEvents {
-					// If we already have a Chatwoot conversation, make sure that
-					// the room has a state event with the Chatwoot conversation
-					// ID.
-					_, err = client.SendStateEvent(ctx, roomID, chatwootConversationIDType, "", ChatwootConversationIDEventContent{
-						ConversationID: chatwootConversationID,
-					})
-					if err != nil {
-						log.Warn().Err(err).Msg("Failed to send conversation_id state event")
-					}
-				}
-			}
+	syncCtx, cancelSync := context.WithCancel(context.Background())
+	// The sync loop and the background loops queue jobs for rooms, so they
+	// all have to stop before the room queue is drained on shutdown.
+	var stopWait sync.WaitGroup
+	runLoop := func(loop func(ctx context.Context)) {
+		stopWait.Add(1)
+		go func() {
+			defer stopWait.Done()
+			loop(log.WithContext(syncCtx))
+		}()
+	}
 
-			log.Info().Msg("finished creating conversations for rooms that don't have a conversation yet... waiting 24 hours to backfill again")
-			time.Sleep(24 * time.Hour)
+	// Start the sync loop
+	runLoop(func(ctx context.Context) {
+		log.Debug().Msg("starting sync loop")
+		err := client.SyncWithContext(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Fatal().Err(err).Msg("Sync error")
 		}
-	}()
+	})
+
+	if keyBackup != nil {
+		runLoop(keyBackup.RunUploadLoop)
+	}
+	if configuration.UndecryptableEventMaxAge > 0 {
+		runLoop(RunUndecryptableEventPruner)
+	}
+	if configuration.ContactEnrichment.Enable {
+		runLoop(RunContactRefreshLoop)
+	}
+	runLoop(RunLabelScheduler)
+	if configuration.RoomCleanup.Enable {
+		runLoop(RunRoomJanitor)
+	}
+	if configuration.Backfill.ChatwootConversations || configuration.Backfill.ConversationIDStateEvents {
+		runLoop(RunConversationBackfillLoop)
+	}
 
 	// Make sure to exit cleanly
 	c := make(chan os.Signal, 1)
@@ -302,36 +459,148 @@ func main() {
 		syscall.SIGQUIT,
 		syscall.SIGTERM,
 	)
-	go func() {
-		for range c { // when the process is killed
-			log.Info().Msg("Cleaning up")
-			cancelSync()
-			db.RawDB.Close()
-			os.Exit(0)
-		}
-	}()
 
 	// Listen to the webhook
 	handler := hlog.NewHandler(*log)(hlog.RequestIDHandler("request_id", "Request-ID")(http.HandlerFunc(HandleWebhook)))
 	http.Handle("/", handler)
 	http.Handle("/webhook", handler)
-	log.Info().Int("listen_port", configuration.ListenPort).Msg("starting webhook listener")
-	err = http.ListenAndServe(fmt.Sprintf(":%d", configuration.ListenPort), nil)
-	if err != nil {
+	http.HandleFunc("/metrics", HandleRetryMetrics)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", configuration.ListenPort)}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		log.Info().Int("listen_port", configuration.ListenPort).Msg("starting webhook listener")
+		listenErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case sig := <-c: // when the process is killed
+		log.Info().Stringer("signal", sig).Msg("Shutting down, no longer accepting webhooks")
+	case err = <-listenErr:
 		log.Error().Err(err).Msg("creating the webhook listener failed")
 	}
 
+	// The whole shutdown has to finish within the shutdown timeout. Another
+	// signal stops waiting for the queued events right away.
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), configuration.ShutdownTimeout)
+	defer cancelShutdown()
+	go func() {
+		sig := <-c
+		log.Warn().Stringer("signal", sig).Msg("Received another signal, no longer waiting for queued events")
+		cancelShutdown()
+	}()
+
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		log.Error().Err(err).Msg("Failed to stop the webhook listener")
+	}
+
+	log.Info().Msg("Stopping sync and background loops")
 	cancelSync()
-	syncStopWait.Wait()
+	if err = waitContext(shutdownCtx, &stopWait); err != nil {
+		log.Warn().Err(err).Msg("Not all background loops stopped before the shutdown deadline")
+	}
+
+	log.Info().Msg("Waiting for queued events to be bridged")
+	if err = roomQueue.Drain(shutdownCtx); err != nil {
+		log.Warn().Err(err).Msg("Not all queued events were bridged before the shutdown deadline")
+	}
+
 	err = cryptoHelper.Close()
+	if err != nil {
+		log.Error().Err(err).Msg("Error closing crypto helper")
+	}
+	err = db.Close()
 	if err != nil {
 		log.Error().Err(err).Msg("Error closing database")
 	}
+	log.Info().Msg("Shutdown complete")
+}
+
+// RunConversationBackfillLoop makes sure that there are conversations for
+// all of the rooms that the bot is in. This is run every 24 hours.
+func RunConversationBackfillLoop(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("component", "conversation_creation_backfill").Logger()
+	ctx = log.WithContext(ctx)
+
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for {
+		log.Info().Msg("starting to create conversations for rooms that don't have a conversation yet")
+		backfillConversations(ctx)
+		log.Info().Msg("finished creating conversations for rooms that don't have a conversation yet... waiting 24 hours to backfill again")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
+func backfillConversations(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+
+	joined, err := client.JoinedRooms(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to get joined rooms")
+		return
+	}
+
+	for _, roomID := range joined.JoinedRooms {
+		if ctx.Err() != nil {
+			return
+		}
+		chatwootConversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, roomID)
+		if err != nil {
+			// This room doesn't already has a Chatwoot conversation
+			// associtaed with it.
+			if configuration.Backfill.ChatwootConversations {
+				err = backfillConversationForRoom(ctx, roomID)
+				if err != nil {
+					log.Warn().Err(err).Msg("Failed to backfill conversation for room")
+					continue
+				}
+			}
+		} else if configuration.Backfill.ConversationIDStateEvents {
+			// If we already have a Chatwoot conversation, make sure that
+			// the room has a state event with the Chatwoot conversation
+			// ID.
+			_, err = client.SendStateEvent(ctx, roomID, chatwootConversationIDType, "", ChatwootConversationIDEventContent{
+				ConversationID: chatwootConversationID,
+			})
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to send conversation_id state event")
+			}
+		}
+	}
+}
+
+// backfillConversationForRoom creates a conversation for the room from its
+// latest message. The conversation is created in the room queue, so that live
+// events for the room are bridged after the history that is imported with it.
 func backfillConversationForRoom(ctx context.Context, roomID id.RoomID) error {
+	// Queued jobs are drained on shutdown, so the job shouldn't be cancelled
+	// when the backfill loop stops.
+	jobCtx := context.WithoutCancel(ctx)
+	done := make(chan error, 1)
+	roomQueue.Enqueue(roomID, func() { done <- createConversationFromLatestMessage(jobCtx, roomID) })
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func createConversationFromLatestMessage(ctx context.Context, roomID id.RoomID) error {
 	log := zerolog.Ctx(ctx).With().Stringer("room_id", roomID).Logger()
 
+	// A live event may have created the conversation while the job was queued.
+	if _, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, roomID); err == nil {
+		log.Debug().Msg("Room already has a conversation")
+		return nil
+	}
+
 	log.Info().Msg("Creating conversation for room")
 
 	messages, err := client.Messages(ctx, roomID, "", "", mautrix.DirectionBackward, nil, 50)
@@ -341,14 +610,24 @@ func backfillConversationForRoom(ctx context.Context, roomID id.RoomID) error {
 	}
 
 	// Iterating through the messages will go in reverse order, so find
-	// the most recent message event and use that to create the
-	// conversation.
+	// the most recent message event and handle it as if it was just
+	// received. This creates the conversation and imports the history before
+	// the message.
 	for _, evt := range messages.Chunk {
 		if evt.Type != event.EventMessage && evt.Type != event.EventEncrypted {
 			continue
 		}
+		evt.RoomID = roomID
+		parsed, err := parseFetchedEvent(ctx, evt)
+		if err != nil {
+			log.Warn().Err(err).Stringer("event_id", evt.ID).Msg("failed to parse message, trying an older one")
+			continue
+		} else if parsed.Type != event.EventMessage {
+			continue
+		}
 
-		chatwootConversationID, err := GetOrCreateChatwootConversation(ctx, roomID, evt)
+		HandleMessage(withReplayedEvent(ctx), parsed)
+		chatwootConversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, roomID)
 		if err != nil {
 			log.Warn().Err(err).Msg("failed to get or create Chatwoot conversation")
 			continue
@@ -363,6 +642,109 @@ func backfillConversationForRoom(ctx context.Context, roomID id.RoomID) error {
 	return fmt.Errorf("no messages found for room suitable for creating conversation")
 }
 
+// backfillHistoryForConversation copies the most recent Matrix messages in the
+// room that were sent before the given event into the given Chatwoot
+// conversation, oldest first. The event itself is not copied, since it is
+// bridged by the caller. The number of messages is limited by the
+// backfill.history configuration. Edits are not copied, since the edited
+// messages are fetched with their latest content.
+func backfillHistoryForConversation(ctx context.Context, roomID id.RoomID, conversationID chatwootapi.ConversationID, before *event.Event) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "backfill_history").
+		Int("conversation_id", int(conversationID)).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	maxMessages := configuration.Backfill.History.MaxMessages
+	since, err := configuration.Backfill.History.GetSince()
+	if err != nil {
+		return fmt.Errorf("invalid backfill history since timestamp: %w", err)
+	}
+	if maxMessages <= 0 && since.IsZero() {
+		return fmt.Errorf("neither max_messages nor since is configured for history backfill")
+	}
+
+	// Paginate backwards until we have enough messages or we hit the since
+	// timestamp.
+	var events []*event.Event
+	var from string
+	for maxMessages <= 0 || len(events) < maxMessages {
+		messages, err := client.Messages(ctx, roomID, from, "", mautrix.DirectionBackward, nil, 100)
+		if err != nil {
+			return fmt.Errorf("failed to get messages for room: %w", err)
+		}
+
+		reachedSince := false
+		for _, evt := range messages.Chunk {
+			if !since.IsZero() && time.UnixMilli(evt.Timestamp).Before(since) {
+				reachedSince = true
+				break
+			}
+			if evt.Type != event.EventMessage && evt.Type != event.EventEncrypted {
+				continue
+			} else if evt.Unsigned.RedactedBecause != nil {
+				continue
+			} else if before != nil && (evt.ID == before.ID || evt.Timestamp > before.Timestamp) {
+				continue
+			}
+			if relatesTo, ok := evt.Content.Raw["m.relates_to"].(map[string]any); ok && relatesTo["rel_type"] == string(event.RelReplace) {
+				continue
+			}
+			events = append(events, evt)
+			if maxMessages > 0 && len(events) >= maxMessages {
+				break
+			}
+		}
+
+		if reachedSince || len(messages.Chunk) == 0 || messages.End == "" {
+			break
+		}
+		from = messages.End
+	}
+
+	log.Info().Int("event_count", len(events)).Msg("backfilling history into conversation")
+	ctx = withReplayedEvent(ctx)
+
+	bridged := 0
+	for i := len(events) - 1; i >= 0; i-- {
+		evt, err := parseFetchedEvent(ctx, events[i])
+		if err != nil {
+			log.Warn().Err(err).Stringer("event_id", events[i].ID).Msg("failed to parse historical event, skipping")
+			continue
+		} else if evt.Type != event.EventMessage {
+			continue
+		} else if relatesTo := evt.Content.AsMessage().RelatesTo; relatesTo != nil && relatesTo.Type == event.RelReplace {
+			// Encrypted edits can only be recognized after decrypting them.
+			continue
+		}
+
+		if messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, evt.ID); err == nil && len(messageIDs) > 0 {
+			continue
+		}
+
+		cm, err := DoRetryArr(ctx, RetryChatwootSend, fmt.Sprintf("backfill matrix event %s in conversation %d", evt.ID, conversationID), func(ctx context.Context) ([]*chatwootapi.Message, error) {
+			return HandleMatrixMessageContent(ctx, evt, conversationID, evt.Content.AsMessage())
+		})
+		if err != nil {
+			log.Warn().Err(err).Stringer("event_id", evt.ID).Msg("failed to backfill historical event")
+			continue
+		}
+		for _, m := range cm {
+			stateStore.SetChatwootMessageIDForMatrixEvent(ctx, evt.ID, m.ID)
+		}
+		bridged++
+	}
+
+	if bridged > 0 {
+		_, err = chatwootAPI.SendPrivateMessage(ctx, conversationID,
+			fmt.Sprintf("Imported %d messages from the Matrix room history. Message times reflect when they were imported, not when they were sent.", bridged))
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to send history backfill note")
+		}
+	}
+	return nil
+}
+
 func AllowKeyShare(ctx context.Context, device *id.Device, info event.RequestedKeyInfo) *crypto.KeyShareRejection {
 	log := *zerolog.Ctx(ctx)
 
@@ -387,13 +769,22 @@ func AllowKeyShare(ctx context.Context, device *id.Device, info event.RequestedK
 	log = log.With().Int("sender_identifier", int(conversation.Meta.Sender.ID)).Logger()
 
 	// This is the user that we expected for this Chatwoot conversation.
-	if conversation.Meta.Sender.Identifier == device.UserID.String() {
-		log.Info().Msg("Chatwoot conversation contact identifier matched device that was requesting the key. Allowing.")
-		return nil
-	} else {
+	if conversation.Meta.Sender.Identifier != device.UserID.String() {
 		log.Info().Msg("rejecting key share request")
 		return &crypto.KeyShareRejectNoResponse
 	}
+
+	minTrust := configuration.DeviceTrust.Policy.MinTrust()
+	if trust := resolveDeviceTrust(ctx, device); trust < minTrust {
+		log.Info().
+			Stringer("device_trust", trust).
+			Stringer("min_trust", minTrust).
+			Msg("rejecting key share request from untrusted device")
+		return &crypto.KeyShareRejectUnverified
+	} else {
+		log.Info().Msg("Chatwoot conversation contact identifier matched device that was requesting the key. Allowing.")
+		return nil
+	}
 }
 
 func VerifyFromAuthorizedUser(ctx context.Context, sender id.UserID) bool {
@@ -12,6 +12,7 @@ import (
 	"net/textproto"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/rs/zerolog"
@@ -32,6 +33,25 @@ const (
 	ConversationStatusPending  ConversationStatus = "pending"
 )
 
+type ConversationPriority string
+
+const (
+	ConversationPriorityNone   ConversationPriority = ""
+	ConversationPriorityLow    ConversationPriority = "low"
+	ConversationPriorityMedium ConversationPriority = "medium"
+	ConversationPriorityHigh   ConversationPriority = "high"
+	ConversationPriorityUrgent ConversationPriority = "urgent"
+)
+
+func (p ConversationPriority) IsValid() bool {
+	switch p {
+	case ConversationPriorityNone, ConversationPriorityLow, ConversationPriorityMedium, ConversationPriorityHigh, ConversationPriorityUrgent:
+		return true
+	default:
+		return false
+	}
+}
+
 type ChatwootAPI struct {
 	BaseURL     string
 	AccountID   AccountID
@@ -39,6 +59,10 @@ type ChatwootAPI struct {
 	AccessToken string
 
 	Client *http.Client
+
+	// RateLimiter limits the rate of requests to Chatwoot. If nil, requests
+	// are not limited.
+	RateLimiter *RateLimiter
 }
 
 func CreateChatwootAPI(baseURL string, accountID AccountID, inboxID InboxID, accessToken string) *ChatwootAPI {
@@ -59,8 +83,16 @@ func CreateChatwootAPI(baseURL string, accountID AccountID, inboxID InboxID, acc
 }
 
 func (api *ChatwootAPI) DoRequest(req *http.Request) (*http.Response, error) {
+	if api.RateLimiter != nil {
+		if err := api.RateLimiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
 	req.Header.Add("API_ACCESS_TOKEN", api.AccessToken)
-	req.Header.Set("Content-Type", "application/json")
+	// Multipart uploads set their own content type.
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	return api.Client.Do(req)
 }
 
@@ -73,6 +105,16 @@ func (api *ChatwootAPI) MakeURI(endpoint string) string {
 	return url.String()
 }
 
+// MakePublicURI returns the URI of an endpoint in Chatwoot's public API.
+func (api *ChatwootAPI) MakePublicURI(endpoint string) string {
+	url, err := url.Parse(api.BaseURL)
+	if err != nil {
+		panic(err)
+	}
+	url.Path = path.Join(url.Path, "public/api/v1", endpoint)
+	return url.String()
+}
+
 func (api *ChatwootAPI) CreateContact(ctx context.Context, identifier string) (ContactID, error) {
 	log := zerolog.Ctx(ctx).With().
 		Str("component", "create_contact").
@@ -98,9 +140,9 @@ func (api *ChatwootAPI) CreateContact(ctx context.Context, identifier string) (C
 		return 0, err
 	}
 	if resp.StatusCode != 200 {
-		data, _ := io.ReadAll(resp.Body)
-		log.Error().Str("data", string(data)).Int("status", resp.StatusCode).Msg("failed to create contact")
-		return 0, fmt.Errorf("POST contacts returned non-200 status code: %d", resp.StatusCode)
+		err := newError(resp, "contacts")
+		log.Error().Str("data", err.Body).Int("status", resp.StatusCode).Msg("failed to create contact")
+		return 0, err
 	}
 
 	var contactPayload ContactPayload
@@ -112,38 +154,184 @@ func (api *ChatwootAPI) CreateContact(ctx context.Context, identifier string) (C
 	return contactPayload.Payload.Contact.ID, nil
 }
 
-func (api *ChatwootAPI) ContactIDForIdentifier(ctx context.Context, identifier string) (ContactID, error) {
-	log := zerolog.Ctx(ctx)
-	log.Info().Str("query", identifier).Msg("Searching for contact")
+func (api *ChatwootAPI) UpdateContact(ctx context.Context, contactID ContactID, payload UpdateContactPayload) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "update_contact").
+		Int("contact_id", int(contactID)).
+		Logger()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api.MakeURI("contacts/search"), nil)
+	log.Info().Msg("Updating contact")
+	jsonValue, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, api.MakeURI(fmt.Sprintf("contacts/%d", contactID)), bytes.NewBuffer(jsonValue))
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	resp, err := api.DoRequest(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		err := newError(resp, fmt.Sprintf("contacts/%d", contactID))
+		log.Error().Str("data", err.Body).Int("status", resp.StatusCode).Msg("failed to update contact")
+		return err
+	}
+	return nil
+}
+
+func (api *ChatwootAPI) UpdateContactAvatar(ctx context.Context, contactID ContactID, filename string, mimeType string, fileData io.Reader) error {
+	bodyBuf := &bytes.Buffer{}
+	bodyWriter := multipart.NewWriter(bodyBuf)
+
+	h := make(textproto.MIMEHeader)
+	h.Set(
+		"Content-Disposition",
+		fmt.Sprintf(`form-data; name="avatar"; filename="%s"`, quoteEscaper.Replace(filename)))
+	if mimeType != "" {
+		h.Set("Content-Type", mimeType)
+	} else {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+	fileWriter, err := bodyWriter.CreatePart(h)
+	if err != nil {
+		return err
 	}
 
-	q := req.URL.Query()
-	q.Add("q", identifier)
+	// Copy the file data into the form.
+	io.Copy(fileWriter, fileData)
+
+	bodyWriter.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, api.MakeURI(fmt.Sprintf("contacts/%d", contactID)), bodyBuf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", bodyWriter.FormDataContentType())
+
+	resp, err := api.DoRequest(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return newError(resp, fmt.Sprintf("contacts/%d", contactID))
+	}
+	return nil
+}
+
+// getContactsPage gets a page of contacts from the list, search or filter
+// endpoints. Pages are numbered from 1.
+func (api *ChatwootAPI) getContactsPage(ctx context.Context, method, endpoint string, query url.Values, body any, page int) (*ContactsPayload, error) {
+	var reqBody io.Reader
+	if body != nil {
+		jsonValue, _ := json.Marshal(body)
+		reqBody = bytes.NewBuffer(jsonValue)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, api.MakeURI(endpoint), reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	for key, values := range query {
+		q[key] = values
+	}
+	q.Set("page", strconv.Itoa(page))
 	req.URL.RawQuery = q.Encode()
 
 	resp, err := api.DoRequest(req)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return 0, fmt.Errorf("GET contacts/search returned non-200 status code: %d", resp.StatusCode)
+		return nil, newError(resp, endpoint)
 	}
 
 	var contactsPayload ContactsPayload
 	if err := json.NewDecoder(resp.Body).Decode(&contactsPayload); err != nil {
-		return 0, err
+		return nil, err
 	}
+	return &contactsPayload, nil
+}
 
-	for _, contact := range contactsPayload.Payload {
+// getAllContactPages gets the contacts on all of the pages of the list,
+// search or filter endpoints.
+func (api *ChatwootAPI) getAllContactPages(ctx context.Context, method, endpoint string, query url.Values, body any) ([]Contact, error) {
+	var contacts []Contact
+	for page := 1; ; page++ {
+		contactsPayload, err := api.getContactsPage(ctx, method, endpoint, query, body, page)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, contactsPayload.Payload...)
+		if len(contactsPayload.Payload) == 0 || len(contacts) >= contactsPayload.Meta.Count {
+			return contacts, nil
+		}
+	}
+}
+
+// ListContactsPage gets a page of all of the contacts in the account. Pages
+// are numbered from 1.
+func (api *ChatwootAPI) ListContactsPage(ctx context.Context, page int) (*ContactsPayload, error) {
+	return api.getContactsPage(ctx, http.MethodGet, "contacts", nil, nil, page)
+}
+
+// ListContacts gets all of the contacts in the account.
+func (api *ChatwootAPI) ListContacts(ctx context.Context) ([]Contact, error) {
+	return api.getAllContactPages(ctx, http.MethodGet, "contacts", nil, nil)
+}
+
+// SearchContactsPage gets a page of the contacts whose name, identifier,
+// email or phone number contains the query. Pages are numbered from 1.
+func (api *ChatwootAPI) SearchContactsPage(ctx context.Context, query string, page int) (*ContactsPayload, error) {
+	return api.getContactsPage(ctx, http.MethodGet, "contacts/search", url.Values{"q": {query}}, nil, page)
+}
+
+// SearchContacts gets all of the contacts whose name, identifier, email or
+// phone number contains the query.
+func (api *ChatwootAPI) SearchContacts(ctx context.Context, query string) ([]Contact, error) {
+	zerolog.Ctx(ctx).Info().Str("query", query).Msg("Searching for contact")
+	return api.getAllContactPages(ctx, http.MethodGet, "contacts/search", url.Values{"q": {query}}, nil)
+}
+
+// FilterContactsPage gets a page of the contacts that match the filter. Pages
+// are numbered from 1.
+func (api *ChatwootAPI) FilterContactsPage(ctx context.Context, filter []ContactFilter, page int) (*ContactsPayload, error) {
+	return api.getContactsPage(ctx, http.MethodPost, "contacts/filter", nil, ContactFilterPayload{Payload: filter}, page)
+}
+
+// FilterContacts gets all of the contacts that match the filter.
+func (api *ChatwootAPI) FilterContacts(ctx context.Context, filter []ContactFilter) ([]Contact, error) {
+	return api.getAllContactPages(ctx, http.MethodPost, "contacts/filter", nil, ContactFilterPayload{Payload: filter})
+}
+
+// ContactIDForIdentifier returns the ID of the contact whose identifier, email
+// or phone number is exactly the given identifier. It uses the contact filter
+// API, and falls back to searching all of the contacts if filtering fails.
+func (api *ChatwootAPI) ContactIDForIdentifier(ctx context.Context, identifier string) (ContactID, error) {
+	log := zerolog.Ctx(ctx)
+
+	contacts, err := api.FilterContacts(ctx, []ContactFilter{
+		{AttributeKey: "identifier", FilterOperator: "equal_to", Values: []string{identifier}, QueryOperator: "OR"},
+		{AttributeKey: "email", FilterOperator: "equal_to", Values: []string{identifier}, QueryOperator: "OR"},
+		{AttributeKey: "phone_number", FilterOperator: "equal_to", Values: []string{identifier}},
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to filter contacts, falling back to search")
+		contacts, err = api.SearchContacts(ctx, identifier)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Prefer a contact with a matching identifier over one with a matching
+	// email or phone number.
+	for _, contact := range contacts {
 		if contact.Identifier == identifier {
 			return contact.ID, nil
-		} else if contact.Email == identifier {
-			return contact.ID, nil
-		} else if contact.PhoneNumber == identifier {
+		}
+	}
+	for _, contact := range contacts {
+		if contact.Email == identifier || contact.PhoneNumber == identifier {
 			return contact.ID, nil
 		}
 	}
@@ -151,6 +339,59 @@ func (api *ChatwootAPI) ContactIDForIdentifier(ctx context.Context, identifier s
 	return 0, fmt.Errorf("couldn't find user with identifier %s", identifier)
 }
 
+func (api *ChatwootAPI) GetContact(ctx context.Context, contactID ContactID) (*Contact, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api.MakeURI(fmt.Sprintf("contacts/%d", contactID)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := api.DoRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, newError(resp, fmt.Sprintf("contacts/%d", contactID))
+	}
+
+	var contactPayload SingleContactPayload
+	if err := json.NewDecoder(resp.Body).Decode(&contactPayload); err != nil {
+		return nil, err
+	}
+	return &contactPayload.Payload, nil
+}
+
+// MergeContacts merges the mergee contact into the base contact. The
+// conversations of the mergee contact are moved to the base contact and the
+// mergee contact is deleted.
+func (api *ChatwootAPI) MergeContacts(ctx context.Context, baseContactID, mergeeContactID ContactID) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "merge_contacts").
+		Int("base_contact_id", int(baseContactID)).
+		Int("mergee_contact_id", int(mergeeContactID)).
+		Logger()
+
+	log.Info().Msg("Merging contacts")
+	jsonValue, _ := json.Marshal(ContactMergePayload{
+		BaseContactID:   baseContactID,
+		MergeeContactID: mergeeContactID,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api.MakeURI("actions/contact_merge"), bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return err
+	}
+
+	resp, err := api.DoRequest(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		err := newError(resp, "actions/contact_merge")
+		log.Error().Str("data", err.Body).Int("status", resp.StatusCode).Msg("failed to merge contacts")
+		return err
+	}
+	return nil
+}
+
 func (api *ChatwootAPI) GetChatwootConversation(ctx context.Context, conversationID ConversationID) (*Conversation, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api.MakeURI(fmt.Sprintf("conversations/%d", conversationID)), nil)
 	if err != nil {
@@ -162,7 +403,7 @@ func (api *ChatwootAPI) GetChatwootConversation(ctx context.Context, conversatio
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("GET conversations/%d returned non-200 status code: %d", conversationID, resp.StatusCode)
+		return nil, newError(resp, fmt.Sprintf("conversations/%d", conversationID))
 	}
 
 	var conversation Conversation
@@ -189,8 +430,7 @@ func (api *ChatwootAPI) CreateConversation(ctx context.Context, sourceID string,
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("POST conversations returned non-200 status code: %d: %s", resp.StatusCode, string(content))
+		return nil, newError(resp, "conversations")
 	}
 
 	var conversation Conversation
@@ -208,8 +448,7 @@ func (api *ChatwootAPI) GetConversation(ctx context.Context, id ConversationID)
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("GET conversation returned non-200 status code: %d: %s", resp.StatusCode, content)
+		return nil, newError(resp, fmt.Sprintf("conversations/%d", id))
 	}
 
 	var conversation Conversation
@@ -228,8 +467,7 @@ func (api *ChatwootAPI) GetConversationLabels(ctx context.Context, conversationI
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("GET conversation labels returned non-200 status code: %d: %s", resp.StatusCode, content)
+		return nil, newError(resp, fmt.Sprintf("conversations/%d/labels", conversationID))
 	}
 
 	var labels ConversationLabelsPayload
@@ -252,8 +490,7 @@ func (api *ChatwootAPI) SetConversationLabels(ctx context.Context, conversationI
 		return err
 	}
 	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("POST conversations returned non-200 status code: %d: %s", resp.StatusCode, string(content))
+		return newError(resp, fmt.Sprintf("conversations/%d/labels", conversationID))
 	}
 	return nil
 }
@@ -272,7 +509,26 @@ func (api *ChatwootAPI) SetConversationCustomAttributes(ctx context.Context, con
 		return err
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("POST conversations/%d/custom_attributes returned non-200 status code: %d", conversationID, resp.StatusCode)
+		return newError(resp, fmt.Sprintf("conversations/%d/custom_attributes", conversationID))
+	}
+	return nil
+}
+
+func (api *ChatwootAPI) SetConversationAdditionalAttributes(ctx context.Context, conversationID ConversationID, additionalAttrs map[string]any) error {
+	jsonValue, _ := json.Marshal(map[string]any{
+		"additional_attributes": additionalAttrs,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, api.MakeURI(fmt.Sprintf("conversations/%d", conversationID)), bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return err
+	}
+
+	resp, err := api.DoRequest(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return newError(resp, fmt.Sprintf("conversations/%d", conversationID))
 	}
 	return nil
 }
@@ -295,8 +551,7 @@ func (api *ChatwootAPI) doSendTextMessage(ctx context.Context, conversationID Co
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("POST conversations/%d/messages returned non-200 status code: %d: %s", conversationID, resp.StatusCode, string(content))
+		return nil, newError(resp, fmt.Sprintf("conversations/%d/messages", conversationID))
 	}
 
 	decoder := json.NewDecoder(resp.Body)
@@ -310,11 +565,77 @@ func (api *ChatwootAPI) SendTextMessage(ctx context.Context, conversationID Conv
 	return api.doSendTextMessage(ctx, conversationID, values)
 }
 
+// SendSubmittedValuesMessage sends an incoming message containing the
+// customer's answer to an interactive message.
+func (api *ChatwootAPI) SendSubmittedValuesMessage(ctx context.Context, conversationID ConversationID, content string, submittedValues []SubmittedValue) (*Message, error) {
+	values := map[string]any{
+		"content":      content,
+		"message_type": IncomingMessage,
+		"private":      false,
+		"content_attributes": map[string]any{
+			"submitted_values": submittedValues,
+		},
+	}
+	return api.doSendTextMessage(ctx, conversationID, values)
+}
+
 func (api *ChatwootAPI) SendPrivateMessage(ctx context.Context, conversationID ConversationID, content string) (*Message, error) {
 	values := map[string]any{"content": content, "message_type": OutgoingMessage, "private": true}
 	return api.doSendTextMessage(ctx, conversationID, values)
 }
 
+// AssignTeam assigns the conversation to the team.
+func (api *ChatwootAPI) AssignTeam(ctx context.Context, conversationID ConversationID, teamID TeamID) error {
+	return api.assign(ctx, conversationID, map[string]any{"team_id": teamID})
+}
+
+// AssignAgent assigns the conversation to the agent.
+func (api *ChatwootAPI) AssignAgent(ctx context.Context, conversationID ConversationID, agentID AgentID) error {
+	return api.assign(ctx, conversationID, map[string]any{"assignee_id": agentID})
+}
+
+func (api *ChatwootAPI) assign(ctx context.Context, conversationID ConversationID, values map[string]any) error {
+	jsonValue, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api.MakeURI(fmt.Sprintf("conversations/%d/assignments", conversationID)), bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return err
+	}
+	resp, err := api.DoRequest(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return newError(resp, fmt.Sprintf("conversations/%d/assignments", conversationID))
+	}
+	return nil
+}
+
+func (api *ChatwootAPI) SetConversationPriority(ctx context.Context, conversationID ConversationID, priority ConversationPriority) error {
+	values := map[string]any{"priority": nil}
+	if priority != ConversationPriorityNone {
+		values["priority"] = priority
+	}
+	jsonValue, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api.MakeURI(fmt.Sprintf("conversations/%d/toggle_priority", conversationID)), bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return err
+	}
+	resp, err := api.DoRequest(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return newError(resp, fmt.Sprintf("conversations/%d/toggle_priority", conversationID))
+	}
+	return nil
+}
+
 func (api *ChatwootAPI) ToggleStatus(ctx context.Context, conversationID ConversationID, status ConversationStatus) error {
 	jsonValue, err := json.Marshal(map[string]any{"status": status})
 	if err != nil {
@@ -329,8 +650,7 @@ func (api *ChatwootAPI) ToggleStatus(ctx context.Context, conversationID Convers
 		return err
 	}
 	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("POST conversations/%d/toggle_status returned non-200 status code: %d: %s", conversationID, resp.StatusCode, string(content))
+		return newError(resp, fmt.Sprintf("conversations/%d/toggle_status", conversationID))
 	}
 	return nil
 }
@@ -382,16 +702,14 @@ func (api *ChatwootAPI) SendAttachmentMessage(ctx context.Context, conversationI
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("API_ACCESS_TOKEN", api.AccessToken)
 	req.Header.Set("Content-Type", bodyWriter.FormDataContentType())
 
-	resp, err := api.Client.Do(req)
+	resp, err := api.DoRequest(req)
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("POST conversations/%d/messages returned non-200 status code: %d: %s", conversationID, resp.StatusCode, string(content))
+		return nil, newError(resp, fmt.Sprintf("conversations/%d/messages", conversationID))
 	}
 
 	decoder := json.NewDecoder(resp.Body)
@@ -416,7 +734,7 @@ func (api *ChatwootAPI) DownloadAttachment(ctx context.Context, url string) ([]b
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("GET attachment returned non-200 status code: %d", resp.StatusCode)
+		return nil, newError(resp, "attachment")
 	}
 
 	data, err := io.ReadAll(resp.Body)
@@ -438,8 +756,39 @@ func (api *ChatwootAPI) DeleteMessage(ctx context.Context, conversationID Conver
 		return err
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("GET attachment returned non-200 status code: %d", resp.StatusCode)
+		return newError(resp, fmt.Sprintf("conversations/%d/messages/%d", conversationID, messageID))
 	}
 
 	return nil
 }
+
+// SubmitCSATResponse submits the customer's satisfaction rating (1-5) and
+// optional feedback for the conversation with the given UUID.
+func (api *ChatwootAPI) SubmitCSATResponse(ctx context.Context, conversationUUID string, rating int, feedback string) error {
+	jsonValue, err := json.Marshal(map[string]any{
+		"message": map[string]any{
+			"submitted_values": map[string]any{
+				"csat_survey_response": map[string]any{
+					"rating":           rating,
+					"feedback_message": feedback,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, api.MakePublicURI(fmt.Sprintf("csat_survey/%s", conversationUUID)), bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return err
+	}
+
+	resp, err := api.DoRequest(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return newError(resp, fmt.Sprintf("csat_survey/%s", conversationUUID))
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package chatwootapi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error is returned by the ChatwootAPI methods when Chatwoot responds with a
+// non-200 status code.
+type Error struct {
+	Method     string
+	Endpoint   string
+	StatusCode int
+	Body       string
+
+	// RetryAfter is how long Chatwoot asked us to wait before retrying. It is
+	// only set if the response had a Retry-After header.
+	RetryAfter time.Duration
+}
+
+func newError(resp *http.Response, endpoint string) *Error {
+	body, _ := io.ReadAll(resp.Body)
+	return &Error{
+		Method:     resp.Request.Method,
+		Endpoint:   endpoint,
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func (e *Error) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s %s returned non-200 status code: %d", e.Method, e.Endpoint, e.StatusCode)
+	}
+	return fmt.Sprintf("%s %s returned non-200 status code: %d: %s", e.Method, e.Endpoint, e.StatusCode, e.Body)
+}
+
+// IsRateLimited returns whether Chatwoot rejected the request because too many
+// requests were made.
+func (e *Error) IsRateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// IsPermanent returns whether retrying the request is pointless. Client errors
+// such as 404 and 422 are permanent, except for timeouts and rate limits.
+func (e *Error) IsPermanent() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 &&
+		e.StatusCode != http.StatusRequestTimeout &&
+		e.StatusCode != http.StatusTooManyRequests
+}
+
+// IsPermanent returns whether the error is a Chatwoot error that is permanent.
+func IsPermanent(err error) bool {
+	var chatwootErr *Error
+	return errors.As(err, &chatwootErr) && chatwootErr.IsPermanent()
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
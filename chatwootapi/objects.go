@@ -7,6 +7,8 @@ type InboxID int
 type MessageID int
 type AttachmentID int
 type SenderID int
+type TeamID int
+type AgentID int
 
 // Contact
 type Contact struct {
@@ -16,8 +18,33 @@ type Contact struct {
 	Email       string    `json:"email,omitempty"`
 }
 
+// ContactsMeta is the pagination metadata of the contact list, search and
+// filter endpoints.
+type ContactsMeta struct {
+	// Count is the total number of contacts on all pages.
+	Count int `json:"count"`
+}
+
 type ContactsPayload struct {
-	Payload []Contact `json:"payload"`
+	Meta    ContactsMeta `json:"meta"`
+	Payload []Contact    `json:"payload"`
+}
+
+// ContactFilter is a condition of a contact filter query. The conditions are
+// combined with the query operator of the previous condition.
+type ContactFilter struct {
+	AttributeKey   string   `json:"attribute_key"`
+	FilterOperator string   `json:"filter_operator"`
+	Values         []string `json:"values"`
+	QueryOperator  string   `json:"query_operator,omitempty"`
+}
+
+type ContactFilterPayload struct {
+	Payload []ContactFilter `json:"payload"`
+}
+
+type SingleContactPayload struct {
+	Payload Contact `json:"payload"`
 }
 
 type ContactPayloadInner struct {
@@ -35,6 +62,18 @@ type CreateContactPayload struct {
 	Identifier  string  `json:"identifier"`
 }
 
+type ContactMergePayload struct {
+	BaseContactID   ContactID `json:"base_contact_id"`
+	MergeeContactID ContactID `json:"mergee_contact_id"`
+}
+
+type UpdateContactPayload struct {
+	Name                 string         `json:"name,omitempty"`
+	Email                string         `json:"email,omitempty"`
+	PhoneNumber          string         `json:"phone_number,omitempty"`
+	AdditionalAttributes map[string]any `json:"additional_attributes,omitempty"`
+}
+
 // Attachment
 
 type Attachment struct {
@@ -44,6 +83,11 @@ type Attachment struct {
 	AccountID AccountID    `json:"account_id"`
 	DataURL   string       `json:"data_url"`
 	ThumbURL  string       `json:"thumb_url"`
+
+	// Only set for location and contact attachments
+	CoordinatesLat  float64 `json:"coordinates_lat,omitempty"`
+	CoordinatesLong float64 `json:"coordinates_long,omitempty"`
+	FallbackTitle   string  `json:"fallback_title,omitempty"`
 }
 
 // Message
@@ -71,11 +115,14 @@ type ConversationMeta struct {
 
 type Conversation struct {
 	ID               ConversationID    `json:"id"`
+	UUID             string            `json:"uuid"`
 	AccountID        AccountID         `json:"account_id"`
 	InboxID          InboxID           `json:"inbox_id"`
 	Messages         []Message         `json:"messages"`
 	Meta             ConversationMeta  `json:"meta"`
 	CustomAttributes map[string]string `json:"custom_attributes"`
+
+	AdditionalAttributes map[string]any `json:"additional_attributes"`
 }
 
 type ConversationsPayload struct {
@@ -88,8 +135,58 @@ type ConversationLabelsPayload struct {
 
 // Content Attributes
 
+type ContentType string
+
+const (
+	ContentTypeText        ContentType = "text"
+	ContentTypeInputSelect ContentType = "input_select"
+	ContentTypeCards       ContentType = "cards"
+	ContentTypeForm        ContentType = "form"
+	ContentTypeArticle     ContentType = "article"
+	ContentTypeInputCSAT   ContentType = "input_csat"
+)
+
+type ContentItemAction struct {
+	Type    string `json:"type"`
+	Text    string `json:"text"`
+	URI     string `json:"uri,omitempty"`
+	Payload string `json:"payload,omitempty"`
+}
+
+type FormFieldOption struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// ContentItem is a single item of an interactive message. Which fields are
+// set depends on the content type of the message.
+type ContentItem struct {
+	// input_select, cards, and article
+	Title       string `json:"title,omitempty"`
+	Value       string `json:"value,omitempty"`
+	Description string `json:"description,omitempty"`
+	MediaURL    string `json:"media_url,omitempty"`
+	Link        string `json:"link,omitempty"`
+
+	Actions []ContentItemAction `json:"actions,omitempty"`
+
+	// form
+	Name        string            `json:"name,omitempty"`
+	Type        string            `json:"type,omitempty"`
+	Label       string            `json:"label,omitempty"`
+	Placeholder string            `json:"placeholder,omitempty"`
+	Options     []FormFieldOption `json:"options,omitempty"`
+}
+
+type SubmittedValue struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
 type ContentAttributes struct {
-	Deleted bool `json:"deleted"`
+	Deleted         bool             `json:"deleted"`
+	Items           []ContentItem    `json:"items,omitempty"`
+	SubmittedValues []SubmittedValue `json:"submitted_values,omitempty"`
 }
 
 // Webhook
@@ -99,8 +196,15 @@ type MessageCreated struct {
 	Content           string             `json:"content"`
 	CreatedAt         string             `json:"created_at"`
 	MessageType       string             `json:"message_type"`
-	ContentType       string             `json:"content_type"`
+	ContentType       ContentType        `json:"content_type"`
 	ContentAttributes *ContentAttributes `json:"content_attributes"`
 	Private           bool               `json:"private"`
 	Conversation      Conversation       `json:"conversation"`
 }
+
+// ConversationStatusChanged is the payload of the conversation_status_changed
+// webhook, which contains the conversation itself.
+type ConversationStatusChanged struct {
+	ID     ConversationID     `json:"id"`
+	Status ConversationStatus `json:"status"`
+}
@@ -0,0 +1,65 @@
+package chatwootapi
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket that limits how many requests are made to
+// Chatwoot, so that the bot doesn't get rate limited during bursts of
+// activity such as backfills.
+type RateLimiter struct {
+	lock       sync.Mutex
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+// NewRateLimiter creates a token bucket that allows requestsPerSecond
+// requests on average, with bursts of up to burst requests.
+func NewRateLimiter(requestsPerSecond float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:       requestsPerSecond,
+		burst:      float64(max(burst, 1)),
+		tokens:     float64(max(burst, 1)),
+		lastRefill: time.Now(),
+	}
+}
+
+// reserve takes a token from the bucket and returns how long to wait before
+// the token is available.
+func (rl *RateLimiter) reserve() time.Duration {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	rl.tokens = min(rl.burst, rl.tokens+now.Sub(rl.lastRefill).Seconds()*rl.rate)
+	rl.lastRefill = now
+	rl.tokens--
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+}
+
+// Wait blocks until a request may be made or the context is cancelled.
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+	wait := rl.reserve()
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give the token back since the request won't be made.
+		rl.lock.Lock()
+		rl.tokens = min(rl.burst, rl.tokens+1)
+		rl.lock.Unlock()
+		return ctx.Err()
+	}
+}
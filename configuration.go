@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/dbutil"
@@ -12,9 +14,100 @@ import (
 	"github.com/beeper/chatwoot/chatwootapi"
 )
 
+type BackfillHistoryConfiguration struct {
+	Enable      bool   `yaml:"enable"`
+	MaxMessages int    `yaml:"max_messages"`
+	Since       string `yaml:"since"`
+}
+
+// GetSince returns the parsed since timestamp, or the zero time if no
+// timestamp is configured.
+func (c *BackfillHistoryConfiguration) GetSince() (time.Time, error) {
+	if c.Since == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, c.Since)
+}
+
 type BackfillConfiguration struct {
-	ChatwootConversations     bool `yaml:"chatwoot_conversations"`
-	ConversationIDStateEvents bool `yaml:"conversation_id_state_events"`
+	ChatwootConversations     bool                         `yaml:"chatwoot_conversations"`
+	ConversationIDStateEvents bool                         `yaml:"conversation_id_state_events"`
+	History                   BackfillHistoryConfiguration `yaml:"history"`
+}
+
+type KeyBackupConfiguration struct {
+	Enable          bool `yaml:"enable"`
+	CreateIfMissing bool `yaml:"create_if_missing"`
+}
+
+// DeviceTrustPolicy determines which customer devices receive room keys and
+// which devices' events are accepted.
+type DeviceTrustPolicy string
+
+const (
+	// DeviceTrustAllowAll trusts all devices.
+	DeviceTrustAllowAll DeviceTrustPolicy = "allow_all"
+	// DeviceTrustCrossSigned requires devices to be cross-signed by their
+	// owner.
+	DeviceTrustCrossSigned DeviceTrustPolicy = "cross_signed"
+	// DeviceTrustTOFU requires devices to be cross-signed by the master key
+	// that was seen the first time the bot encountered their owner.
+	DeviceTrustTOFU DeviceTrustPolicy = "tofu"
+)
+
+func (p DeviceTrustPolicy) IsValid() bool {
+	return p == DeviceTrustAllowAll || p == DeviceTrustCrossSigned || p == DeviceTrustTOFU
+}
+
+// MinTrust returns the minimum trust state that a device needs to satisfy the
+// policy.
+func (p DeviceTrustPolicy) MinTrust() id.TrustState {
+	switch p {
+	case DeviceTrustCrossSigned:
+		return id.TrustStateCrossSignedUntrusted
+	case DeviceTrustTOFU:
+		return id.TrustStateCrossSignedTOFU
+	default:
+		return id.TrustStateUnset
+	}
+}
+
+type DeviceTrustConfiguration struct {
+	Policy                DeviceTrustPolicy `yaml:"policy"`
+	RejectUntrustedEvents bool              `yaml:"reject_untrusted_events"`
+}
+
+type ChatwootRateLimit struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+}
+
+// RetryPolicy determines how often and how long an operation is retried. The
+// delay between attempts grows following the Fibonacci sequence.
+type RetryPolicy struct {
+	InitialInterval time.Duration `yaml:"initial_interval"`
+	MaxRetries      uint64        `yaml:"max_retries"`
+	MaxElapsedTime  time.Duration `yaml:"max_elapsed_time"`
+	JitterPercent   uint64        `yaml:"jitter_percent"`
+}
+
+type RetryConfiguration struct {
+	MatrixSend    RetryPolicy `yaml:"matrix_send"`
+	ChatwootSend  RetryPolicy `yaml:"chatwoot_send"`
+	MediaDownload RetryPolicy `yaml:"media_download"`
+}
+
+func (c *RetryConfiguration) PolicyFor(class RetryClass) RetryPolicy {
+	switch class {
+	case RetryMatrixSend:
+		return c.MatrixSend
+	case RetryChatwootSend:
+		return c.ChatwootSend
+	case RetryMediaDownload:
+		return c.MediaDownload
+	default:
+		return defaultRetryPolicy
+	}
 }
 
 type HomeserverWhitelist struct {
@@ -22,12 +115,115 @@ type HomeserverWhitelist struct {
 	Allowed []string `yaml:"allowed"`
 }
 
+// InviteRateLimit limits how many invites from a single user are accepted
+// within the period.
+type InviteRateLimit struct {
+	MaxInvites int           `yaml:"max_invites"`
+	Period     time.Duration `yaml:"period"`
+}
+
+type InvitePolicyConfiguration struct {
+	Enable             bool            `yaml:"enable"`
+	RateLimit          InviteRateLimit `yaml:"rate_limit"`
+	CreateConversation bool            `yaml:"create_conversation"`
+	Greeting           string          `yaml:"greeting"`
+}
+
 type StartNewChat struct {
 	Enable   bool   `yaml:"enable"`
 	Endpoint string `yaml:"endpoint"`
 	Token    string `yaml:"token"`
 }
 
+// ContactIdentifierRule resolves the contact identifier of the users whose
+// MXID matches the UserID regex. The template is expanded with the submatches
+// of the UserID regex or, if BridgeIdentifier is set, with the submatches of
+// the first bridge identifier of the user that matches it.
+type ContactIdentifierRule struct {
+	UserID           string `yaml:"user_id"`
+	BridgeIdentifier string `yaml:"bridge_identifier"`
+	Template         string `yaml:"template"`
+}
+
+type ContactIdentifierConfiguration struct {
+	Builtin []string                `yaml:"builtin"`
+	Rules   []ContactIdentifierRule `yaml:"rules"`
+}
+
+type ContactMergeConfiguration struct {
+	AutoMerge    bool `yaml:"auto_merge"`
+	AgentCommand bool `yaml:"agent_command"`
+}
+
+type ContactEnrichmentConfiguration struct {
+	Enable          bool          `yaml:"enable"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+type RoomCleanupConfiguration struct {
+	Enable              bool          `yaml:"enable"`
+	Interval            time.Duration `yaml:"interval"`
+	LeaveIfCustomerLeft bool          `yaml:"leave_if_customer_left"`
+	InactiveAfter       time.Duration `yaml:"inactive_after"`
+	Forget              bool          `yaml:"forget"`
+}
+
+// AssignmentRule assigns new conversations that match all of the conditions
+// that are set to a team and/or agent, and sets their priority.
+type AssignmentRule struct {
+	// Conditions
+	Network    string `yaml:"network"`
+	Homeserver string `yaml:"homeserver"`
+	RoomName   string `yaml:"room_name"`
+	ClientType string `yaml:"client_type"`
+	Language   string `yaml:"language"`
+
+	// Actions
+	TeamID     chatwootapi.TeamID               `yaml:"team_id"`
+	AssigneeID chatwootapi.AgentID              `yaml:"assignee_id"`
+	Priority   chatwootapi.ConversationPriority `yaml:"priority"`
+}
+
+// CustomAttributeMapping fills in a custom attribute of conversations. See
+// CustomAttributeSource for the available sources.
+type CustomAttributeMapping struct {
+	Attribute string `yaml:"attribute"`
+	Source    string `yaml:"source"`
+	Default   string `yaml:"default"`
+	Overwrite bool   `yaml:"overwrite"`
+}
+
+// LinkRule detects references (for example, issue or order numbers) in
+// messages. The URL template is expanded with the submatches of the pattern
+// for each match.
+type LinkRule struct {
+	Pattern       string   `yaml:"pattern"`
+	URL           string   `yaml:"url"`
+	Labels        []string `yaml:"labels"`
+	AgentMessages bool     `yaml:"agent_messages"`
+}
+
+// LabelRule adds a label to conversations that match all of the conditions
+// that are set. The room conditions are checked when the conversation is
+// created, and the message conditions on every message from the customer.
+type LabelRule struct {
+	Label string `yaml:"label"`
+
+	// Room conditions
+	RoomName   string `yaml:"room_name"`
+	Network    string `yaml:"network"`
+	MinMembers int    `yaml:"min_members"`
+	MaxMembers int    `yaml:"max_members"`
+
+	// Message conditions
+	Keywords   []string `yaml:"keywords"`
+	ClientType string   `yaml:"client_type"`
+}
+
+// LegacyPickleKey is the pickle key that was used for the crypto store before
+// the pickle key was configurable. It is used if no pickle key is configured.
+const LegacyPickleKey = "chatwoot_cryptostore_key"
+
 type Configuration struct {
 	// Authentication settings
 	Homeserver      string    `yaml:"homeserver"`
@@ -35,30 +231,67 @@ type Configuration struct {
 	PasswordFile    string    `yaml:"password_file"`
 	RecoveryKeyFile string    `yaml:"recovery_key_file"`
 
+	// Crypto store encryption settings
+	PickleKeyFile string `yaml:"pickle_key_file"`
+	PickleKeyEnv  string `yaml:"pickle_key_env"`
+
+	// Server-side key backup settings
+	KeyBackup KeyBackupConfiguration `yaml:"key_backup"`
+
+	// Device trust settings
+	DeviceTrust DeviceTrustConfiguration `yaml:"device_trust"`
+
+	// How long to keep events that could not be decrypted while waiting for
+	// their session
+	UndecryptableEventMaxAge time.Duration `yaml:"undecryptable_event_max_age"`
+
 	// Chatwoot Authentication
 	ChatwootBaseUrl         string                `yaml:"chatwoot_base_url"`
 	ChatwootAccessTokenFile string                `yaml:"chatwoot_access_token_file"`
 	ChatwootAccountID       chatwootapi.AccountID `yaml:"chatwoot_account_id"`
 	ChatwootInboxID         chatwootapi.InboxID   `yaml:"chatwoot_inbox_id"`
+	ChatwootRateLimit       ChatwootRateLimit     `yaml:"chatwoot_rate_limit"`
 
 	// Database settings
 	Database dbutil.Config `yaml:"database"`
 
 	// Bot settings
-	HomeserverWhitelist     HomeserverWhitelist `yaml:"homeserver_whitelist"`
-	StartNewChat            StartNewChat        `yaml:"start_new_chat"`
-	CanonicalDMPrefix       string              `yaml:"canonical_dm_prefix"`
-	BridgeIfMembersLessThan int                 `yaml:"bridge_if_members_less_than"`
-	RenderMarkdown          bool                `yaml:"render_markdown"`
+	HomeserverWhitelist     HomeserverWhitelist       `yaml:"homeserver_whitelist"`
+	InvitePolicy            InvitePolicyConfiguration `yaml:"invite_policy"`
+	StartNewChat            StartNewChat              `yaml:"start_new_chat"`
+	CanonicalDMPrefix       string                    `yaml:"canonical_dm_prefix"`
+	BridgeIfMembersLessThan int                       `yaml:"bridge_if_members_less_than"`
+	RenderMarkdown          bool                      `yaml:"render_markdown"`
+	MaxConcurrentRooms      int                       `yaml:"max_concurrent_rooms"`
+	RoomActivityNotes       bool                      `yaml:"room_activity_notes"`
+	RoomCleanup             RoomCleanupConfiguration  `yaml:"room_cleanup"`
+
+	// Contact settings
+	ContactIdentifiers ContactIdentifierConfiguration `yaml:"contact_identifiers"`
+	ContactEnrichment  ContactEnrichmentConfiguration `yaml:"contact_enrichment"`
+	ContactMerge       ContactMergeConfiguration      `yaml:"contact_merge"`
+
+	// Conversation settings
+	AssignmentRules  []AssignmentRule         `yaml:"assignment_rules"`
+	CustomAttributes []CustomAttributeMapping `yaml:"custom_attributes"`
+	LinkRules        []LinkRule               `yaml:"link_rules"`
+	LabelRules       []LabelRule              `yaml:"label_rules"`
+	LabelDelay       time.Duration            `yaml:"label_delay"`
 
 	// Webhook listener settings
 	ListenPort int `yaml:"listen_port"`
 
+	// How long to wait for queued events to be bridged when shutting down
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
 	// Logging configuration
 	Logging zeroconfig.Config `yaml:"logging"`
 
 	// Backfill configuration
 	Backfill BackfillConfiguration `yaml:"backfill"`
+
+	// Retry policies
+	Retry RetryConfiguration `yaml:"retry"`
 }
 
 func (c *Configuration) GetPassword(log *zerolog.Logger) (string, error) {
@@ -90,3 +323,29 @@ func (c *Configuration) GetRecoveryKey(log *zerolog.Logger) (string, error) {
 	}
 	return strings.TrimSpace(string(buf)), nil
 }
+
+// GetPickleKey returns the key that the crypto store is encrypted with. The
+// environment variable takes precedence over the file. If neither is
+// configured, the legacy hard-coded key is returned.
+func (c *Configuration) GetPickleKey(log *zerolog.Logger) ([]byte, error) {
+	if c.PickleKeyEnv != "" {
+		log.Debug().Str("pickle_key_env", c.PickleKeyEnv).Msg("reading pickle key from environment")
+		key := strings.TrimSpace(os.Getenv(c.PickleKeyEnv))
+		if key == "" {
+			return nil, fmt.Errorf("environment variable %s is empty", c.PickleKeyEnv)
+		}
+		return []byte(key), nil
+	} else if c.PickleKeyFile != "" {
+		log.Debug().Str("pickle_key_file", c.PickleKeyFile).Msg("reading pickle key from file")
+		buf, err := os.ReadFile(c.PickleKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.TrimSpace(string(buf))
+		if key == "" {
+			return nil, fmt.Errorf("pickle key file %s is empty", c.PickleKeyFile)
+		}
+		return []byte(key), nil
+	}
+	return []byte(LegacyPickleKey), nil
+}
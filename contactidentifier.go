@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ContactUser is the Matrix user that a contact identifier is resolved for.
+type ContactUser struct {
+	RoomID id.RoomID
+	UserID id.UserID
+	// BridgeIdentifiers are the com.beeper.bridge.identifiers of the user's
+	// member event (for example, tel:+15555550100 or twitter:handle).
+	BridgeIdentifiers []string
+}
+
+// BridgeIdentifier returns the first bridge identifier with the given URI
+// scheme, without the scheme.
+func (u *ContactUser) BridgeIdentifier(scheme string) (string, bool) {
+	for _, identifier := range u.BridgeIdentifiers {
+		if value, ok := strings.CutPrefix(identifier, scheme+":"); ok && value != "" {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// ContactIdentifierResolver resolves the identifier that is used for a Matrix
+// user's contact in Chatwoot.
+type ContactIdentifierResolver interface {
+	// ResolveContactIdentifier returns the contact identifier of the user, or
+	// false if the resolver does not apply to the user.
+	ResolveContactIdentifier(ctx context.Context, user *ContactUser) (string, bool)
+}
+
+// ContactIdentifierResolverFunc is a function that implements
+// ContactIdentifierResolver.
+type ContactIdentifierResolverFunc func(ctx context.Context, user *ContactUser) (string, bool)
+
+func (fn ContactIdentifierResolverFunc) ResolveContactIdentifier(ctx context.Context, user *ContactUser) (string, bool) {
+	return fn(ctx, user)
+}
+
+// puppetResolver returns a resolver for the puppets of a mautrix bridge. The
+// resolve function is only called for users whose localpart starts with the
+// given prefix, and it is passed the rest of the localpart.
+func puppetResolver(prefix string, resolve func(user *ContactUser, localpart string) (string, bool)) ContactIdentifierResolver {
+	return ContactIdentifierResolverFunc(func(ctx context.Context, user *ContactUser) (string, bool) {
+		localpart, ok := strings.CutPrefix(user.UserID.Localpart(), prefix)
+		if !ok {
+			return "", false
+		}
+		return resolve(user, localpart)
+	})
+}
+
+// phoneNumberFromLocalpart returns the phone number of a puppet whose
+// localpart (after the prefix) is the phone number without the leading +.
+func phoneNumberFromLocalpart(localpart string) (string, bool) {
+	if localpart == "" || strings.Trim(localpart, "0123456789") != "" {
+		return "", false
+	}
+	return "+" + localpart, true
+}
+
+// BuiltinContactIdentifierResolvers are the resolvers for the puppets of
+// common mautrix bridges.
+var BuiltinContactIdentifierResolvers = map[string]ContactIdentifierResolver{
+	// Use the Twitter handle. For compatibility with existing contacts, this
+	// only applies to users with exactly one bridge identifier, which is used
+	// with or without the twitter: scheme.
+	"twitter": puppetResolver("twitter_", func(user *ContactUser, _ string) (string, bool) {
+		if len(user.BridgeIdentifiers) != 1 {
+			return "", false
+		}
+		return "@" + strings.TrimPrefix(user.BridgeIdentifiers[0], "twitter:"), true
+	}),
+	// Use the iMessage handle (phone number or email address), which is
+	// encoded in the localpart.
+	"imessage": puppetResolver("imessagego_1.", func(user *ContactUser, localpart string) (string, bool) {
+		if user.UserID.Homeserver() != "beeper.local" {
+			return "", false
+		}
+		decoded, err := id.DecodeUserLocalpart(localpart)
+		return decoded, err == nil
+	}),
+	// Use the phone number.
+	"whatsapp": puppetResolver("whatsapp_", func(user *ContactUser, localpart string) (string, bool) {
+		if phone, ok := user.BridgeIdentifier("tel"); ok {
+			return phone, true
+		}
+		return phoneNumberFromLocalpart(localpart)
+	}),
+	// Use the phone number if it is known. Signal puppets are identified by
+	// a UUID, which is not useful as an identifier.
+	"signal": puppetResolver("signal_", func(user *ContactUser, _ string) (string, bool) {
+		return user.BridgeIdentifier("tel")
+	}),
+	// Use the phone number if it is known, otherwise the Telegram username.
+	"telegram": puppetResolver("telegram_", func(user *ContactUser, _ string) (string, bool) {
+		if phone, ok := user.BridgeIdentifier("tel"); ok {
+			return phone, true
+		} else if username, ok := user.BridgeIdentifier("telegram"); ok {
+			return "telegram:" + username, true
+		}
+		return "", false
+	}),
+	// Use the Instagram username.
+	"instagram": puppetResolver("instagram_", func(user *ContactUser, _ string) (string, bool) {
+		if username, ok := user.BridgeIdentifier("instagram"); ok {
+			return "instagram:" + username, true
+		}
+		return "", false
+	}),
+}
+
+// DefaultBuiltinContactIdentifierResolvers are the names of the built-in
+// resolvers that are used if none are configured. The other resolvers are
+// opt-in, since enabling them changes the identifiers of existing contacts.
+var DefaultBuiltinContactIdentifierResolvers = []string{"twitter", "imessage"}
+
+// regexContactIdentifierResolver is a config-driven resolver that matches the
+// user ID (and optionally a bridge identifier) against regular expressions and
+// expands a template with the submatches.
+type regexContactIdentifierResolver struct {
+	userID           *regexp.Regexp
+	bridgeIdentifier *regexp.Regexp
+	template         string
+}
+
+func (r *regexContactIdentifierResolver) ResolveContactIdentifier(ctx context.Context, user *ContactUser) (string, bool) {
+	match := r.userID.FindStringSubmatchIndex(user.UserID.String())
+	if match == nil {
+		return "", false
+	}
+	if r.bridgeIdentifier == nil {
+		return string(r.userID.ExpandString(nil, r.template, user.UserID.String(), match)), true
+	}
+	for _, identifier := range user.BridgeIdentifiers {
+		if match := r.bridgeIdentifier.FindStringSubmatchIndex(identifier); match != nil {
+			return string(r.bridgeIdentifier.ExpandString(nil, r.template, identifier, match)), true
+		}
+	}
+	return "", false
+}
+
+// contactIdentifierResolvers are the resolvers that are tried, in order, to
+// find the contact identifier of a user.
+var contactIdentifierResolvers []ContactIdentifierResolver
+
+// NewContactIdentifierResolvers builds the list of resolvers from the
+// configuration. The configured rules are tried before the built-in
+// resolvers.
+func NewContactIdentifierResolvers(config ContactIdentifierConfiguration) ([]ContactIdentifierResolver, error) {
+	var resolvers []ContactIdentifierResolver
+	for i, rule := range config.Rules {
+		if rule.UserID == "" || rule.Template == "" {
+			return nil, fmt.Errorf("contact identifier rule %d must have a user_id and a template", i)
+		}
+		userID, err := regexp.Compile(rule.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user_id regex in contact identifier rule %d: %w", i, err)
+		}
+		resolver := &regexContactIdentifierResolver{userID: userID, template: rule.Template}
+		if rule.BridgeIdentifier != "" {
+			resolver.bridgeIdentifier, err = regexp.Compile(rule.BridgeIdentifier)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bridge_identifier regex in contact identifier rule %d: %w", i, err)
+			}
+		}
+		resolvers = append(resolvers, resolver)
+	}
+	for _, name := range config.Builtin {
+		resolver, ok := BuiltinContactIdentifierResolvers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown built-in contact identifier resolver %q", name)
+		}
+		resolvers = append(resolvers, resolver)
+	}
+	return resolvers, nil
+}
+
+// getContactIdentifier returns the identifier to use for a contact in Chatwoot.
+// The first resolver that applies to the user determines the identifier. If no
+// resolver applies, the MXID is used.
+func getContactIdentifier(ctx context.Context, roomID id.RoomID, contactMXID id.UserID) string {
+	log := zerolog.Ctx(ctx)
+
+	user := ContactUser{RoomID: roomID, UserID: contactMXID}
+	memberEventContent := map[string]any{}
+	if err := client.StateEvent(ctx, roomID, event.StateMember, contactMXID.String(), &memberEventContent); err == nil {
+		log.Trace().Any("member_event_content", memberEventContent).Msg("Got member event content")
+		if identifiers, ok := memberEventContent["com.beeper.bridge.identifiers"].([]any); ok {
+			for _, identifier := range identifiers {
+				if identifier, ok := identifier.(string); ok {
+					user.BridgeIdentifiers = append(user.BridgeIdentifiers, identifier)
+				}
+			}
+		}
+	}
+
+	for _, resolver := range contactIdentifierResolvers {
+		if identifier, ok := resolver.ResolveContactIdentifier(ctx, &user); ok && identifier != "" {
+			return identifier
+		}
+	}
+	return contactMXID.String()
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+	"github.com/beeper/chatwoot/database"
+)
+
+// contactProfileRefreshCheckInterval is how often the refresh loop checks for
+// contact profiles that are due to be refreshed.
+const contactProfileRefreshCheckInterval = time.Hour
+
+// resolveContactID returns the ID of the Chatwoot contact with the given
+// identifier, creating the contact if it doesn't exist yet. Contacts that were
+// merged into another contact resolve to that contact. If the contact was
+// automatically merged into a duplicate contact, the merge is returned as well.
+func resolveContactID(ctx context.Context, roomID id.RoomID, contactMXID id.UserID, contactIdentifier string) (chatwootapi.ContactID, *contactMerge, error) {
+	log := zerolog.Ctx(ctx)
+
+	if contactID, err := stateStore.GetContactIDForAlias(ctx, contactIdentifier); err == nil {
+		return contactID, nil, nil
+	} else if contactID, err := stateStore.GetCachedContactID(ctx, contactIdentifier); err == nil {
+		return contactID, nil, nil
+	}
+
+	contactID, err := chatwootAPI.ContactIDForIdentifier(ctx, contactIdentifier)
+	if err != nil {
+		log.Warn().Err(err).Msg("contact ID not found for user, will attempt to create one")
+
+		contactID, err = chatwootAPI.CreateContact(ctx, contactIdentifier)
+		if err != nil {
+			return 0, nil, fmt.Errorf("create contact failed for %s: %w", contactMXID, err)
+		}
+		log.Info().Int("contact_id", int(contactID)).Msg("Contact created")
+	}
+
+	var merge *contactMerge
+	if configuration.ContactMerge.AutoMerge {
+		merge = mergeDuplicateContact(ctx, roomID, contactMXID, &chatwootapi.Contact{ID: contactID, Identifier: contactIdentifier})
+		if merge != nil {
+			contactID = merge.Base.ID
+		}
+	}
+
+	if err = stateStore.SetCachedContactID(ctx, contactIdentifier, contactID); err != nil {
+		log.Warn().Err(err).Msg("failed to cache contact ID")
+	}
+	return contactID, merge, nil
+}
+
+// getContactProfile builds the profile of a Matrix user from their member
+// event and the bridge info of the room.
+func getContactProfile(ctx context.Context, roomID id.RoomID, userID id.UserID, state mautrix.RoomStateMap) *database.ContactProfile {
+	profile := database.ContactProfile{
+		UserID:      userID,
+		RoomID:      roomID,
+		RefreshedAt: time.Now(),
+	}
+	if memberEvent, ok := state[event.StateMember][userID.String()]; ok {
+		if member := memberEvent.Content.AsMember(); member != nil {
+			profile.Name = member.Displayname
+			profile.AvatarMXC = member.AvatarURL
+		}
+		if identifiers, ok := memberEvent.Content.Raw["com.beeper.bridge.identifiers"].([]any); ok {
+			for _, identifier := range identifiers {
+				if identifier, ok := identifier.(string); ok {
+					profile.BridgeIdentifiers = append(profile.BridgeIdentifiers, identifier)
+				}
+			}
+		}
+	}
+
+	for _, bridgeType := range []event.Type{event.StateBridge, event.StateHalfShotBridge} {
+		for _, bridgeEvent := range state[bridgeType] {
+			bridge := bridgeEvent.Content.AsBridge()
+			if bridge.Protocol.DisplayName != "" {
+				profile.BridgeProtocol = bridge.Protocol.DisplayName
+			} else {
+				profile.BridgeProtocol = bridge.Protocol.ID
+			}
+			if profile.BridgeProtocol != "" {
+				break
+			}
+		}
+		if profile.BridgeProtocol != "" {
+			break
+		}
+	}
+
+	// Phone numbers and email addresses can come from the bridge identifiers
+	// (tel: and mailto: URIs) or from the contact identifier itself (for
+	// example, iMessage handles).
+	candidates := append([]string{getContactIdentifier(ctx, roomID, userID)}, profile.BridgeIdentifiers...)
+	for _, candidate := range candidates {
+		if phone, ok := strings.CutPrefix(candidate, "tel:"); ok {
+			candidate = phone
+		} else if email, ok := strings.CutPrefix(candidate, "mailto:"); ok {
+			candidate = email
+		}
+
+		if profile.PhoneNumber == "" && isPhoneNumber(candidate) {
+			profile.PhoneNumber = candidate
+		} else if profile.Email == "" && isEmailAddress(candidate) {
+			profile.Email = candidate
+		}
+	}
+
+	return &profile
+}
+
+func isPhoneNumber(s string) bool {
+	if len(s) < 4 || s[0] != '+' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isEmailAddress(s string) bool {
+	at := strings.IndexByte(s, '@')
+	return at > 0 && at < len(s)-1 && !strings.ContainsAny(s, " :")
+}
+
+// enrichContact updates the Chatwoot contact with the Matrix profile and
+// bridge info of the given user. The contact is only updated if the profile
+// changed since the last time it was enriched.
+func enrichContact(ctx context.Context, roomID id.RoomID, userID id.UserID, contactID chatwootapi.ContactID) error {
+	state, err := client.State(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get room state: %w", err)
+	}
+	return enrichContactFromState(ctx, roomID, userID, contactID, state)
+}
+
+// enrichContactFromState is enrichContact with room state that was already
+// fetched.
+func enrichContactFromState(ctx context.Context, roomID id.RoomID, userID id.UserID, contactID chatwootapi.ContactID, state mautrix.RoomStateMap) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "enrich_contact").
+		Stringer("room_id", roomID).
+		Stringer("user_id", userID).
+		Int("contact_id", int(contactID)).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	profile := getContactProfile(ctx, roomID, userID, state)
+	profile.ContactID = contactID
+
+	previous, err := stateStore.GetContactProfile(ctx, contactID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to get previous contact profile: %w", err)
+	} else if previous != nil && previous.Equal(profile) {
+		log.Debug().Msg("contact profile didn't change")
+		return stateStore.SetContactProfile(ctx, *profile)
+	}
+
+	additionalAttributes := map[string]any{"matrix_user_id": userID.String()}
+	if profile.BridgeProtocol != "" {
+		additionalAttributes["bridge"] = profile.BridgeProtocol
+	}
+	if len(profile.BridgeIdentifiers) > 0 {
+		additionalAttributes["bridge_identifiers"] = profile.BridgeIdentifiers
+	}
+	payload := chatwootapi.UpdateContactPayload{
+		Name:                 profile.Name,
+		Email:                profile.Email,
+		PhoneNumber:          profile.PhoneNumber,
+		AdditionalAttributes: additionalAttributes,
+	}
+	err = chatwootAPI.UpdateContact(ctx, contactID, payload)
+	var chatwootErr *chatwootapi.Error
+	if errors.As(err, &chatwootErr) && chatwootErr.StatusCode == http.StatusUnprocessableEntity &&
+		(payload.Email != "" || payload.PhoneNumber != "") {
+		// Chatwoot rejects phone numbers and email addresses that are already
+		// used by another contact, so try again without them.
+		log.Warn().Err(err).Msg("failed to update contact, retrying without phone number and email")
+		payload.Email = ""
+		payload.PhoneNumber = ""
+		err = chatwootAPI.UpdateContact(ctx, contactID, payload)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update contact: %w", err)
+	}
+
+	if profile.AvatarMXC != "" && (previous == nil || previous.AvatarMXC != profile.AvatarMXC) {
+		if err = updateContactAvatar(ctx, contactID, profile.AvatarMXC); err != nil {
+			// Try again on the next refresh.
+			log.Warn().Err(err).Msg("failed to update contact avatar")
+			if previous != nil {
+				profile.AvatarMXC = previous.AvatarMXC
+			} else {
+				profile.AvatarMXC = ""
+			}
+		}
+	}
+
+	log.Info().Msg("enriched contact with Matrix profile")
+	return stateStore.SetContactProfile(ctx, *profile)
+}
+
+func updateContactAvatar(ctx context.Context, contactID chatwootapi.ContactID, avatarMXC id.ContentURIString) error {
+	mxc, err := avatarMXC.Parse()
+	if err != nil {
+		return fmt.Errorf("invalid avatar URL: %w", err)
+	}
+	data, err := DoRetryArr(ctx, RetryMediaDownload, fmt.Sprintf("download avatar %s", mxc), func(ctx context.Context) ([]byte, error) {
+		return client.DownloadBytes(ctx, mxc)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download avatar: %w", err)
+	}
+	return chatwootAPI.UpdateContactAvatar(ctx, contactID, mxc.FileID, http.DetectContentType(data), bytes.NewReader(data))
+}
+
+// RunContactRefreshLoop periodically re-enriches the contacts whose profile
+// hasn't been refreshed within the configured interval.
+func RunContactRefreshLoop(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("component", "contact_refresh_loop").Logger()
+	ctx = log.WithContext(ctx)
+
+	ticker := time.NewTicker(contactProfileRefreshCheckInterval)
+	defer ticker.Stop()
+	for {
+		profiles, err := stateStore.GetContactProfilesRefreshedBefore(ctx, time.Now().Add(-configuration.ContactEnrichment.RefreshInterval))
+		if err != nil {
+			log.Err(err).Msg("failed to get contact profiles to refresh")
+		}
+		for _, profile := range profiles {
+			if err := enrichContact(ctx, profile.RoomID, profile.UserID, profile.ContactID); err != nil {
+				log.Warn().Err(err).Int("contact_id", int(profile.ContactID)).Msg("failed to refresh contact profile")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// mergeContacts merges the mergee contact into the base contact and records
+// the identifiers of the mergee contact as aliases of the base contact, so
+// that rooms of the mergee contact resolve to the base contact in the future.
+func mergeContacts(ctx context.Context, baseContactID chatwootapi.ContactID, mergee *chatwootapi.Contact) error {
+	if err := chatwootAPI.MergeContacts(ctx, baseContactID, mergee.ID); err != nil {
+		return err
+	}
+	var identifiers []string
+	for _, identifier := range []string{mergee.Identifier, mergee.PhoneNumber, mergee.Email} {
+		if identifier != "" {
+			identifiers = append(identifiers, identifier)
+		}
+	}
+	return stateStore.MergeContactAliases(ctx, baseContactID, mergee.ID, identifiers)
+}
+
+// contactMerge is an automatic merge of a new contact into an existing
+// contact. The existing (base) contact is kept, and the new (merged) contact
+// is deleted.
+type contactMerge struct {
+	Base   *chatwootapi.Contact
+	Merged *chatwootapi.Contact
+	// Match is the phone number or email address that both contacts have.
+	Match string
+}
+
+func formatContact(contact *chatwootapi.Contact) string {
+	if contact.Identifier == "" {
+		return fmt.Sprintf("contact %d", contact.ID)
+	}
+	return fmt.Sprintf("contact %d (%s)", contact.ID, contact.Identifier)
+}
+
+// Note returns the private note that tells the agents about the merge.
+func (m *contactMerge) Note() string {
+	return fmt.Sprintf("**The new %s was automatically merged into the existing %s, which has the same phone number or email address (%s).** The new contact was deleted.",
+		formatContact(m.Merged), formatContact(m.Base), m.Match)
+}
+
+// mergeDuplicateContact merges the contact into another contact that has the
+// same phone number or email address as the Matrix user. The other contact is
+// kept. It returns the merge, or nil if the contact wasn't merged.
+func mergeDuplicateContact(ctx context.Context, roomID id.RoomID, userID id.UserID, contact *chatwootapi.Contact) *contactMerge {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "merge_duplicate_contact").
+		Int("contact_id", int(contact.ID)).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	state, err := client.State(ctx, roomID)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to get room state for contact profile")
+		return nil
+	}
+	profile := getContactProfile(ctx, roomID, userID, state)
+
+	for _, query := range []string{profile.PhoneNumber, profile.Email} {
+		if query == "" {
+			continue
+		}
+		contacts, err := chatwootAPI.SearchContacts(ctx, query)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to search for duplicate contacts")
+			continue
+		}
+		for _, duplicate := range contacts {
+			if duplicate.ID == contact.ID || (duplicate.PhoneNumber != query && duplicate.Email != query) {
+				continue
+			}
+			log := log.With().Int("base_contact_id", int(duplicate.ID)).Logger()
+			if err := mergeContacts(ctx, duplicate.ID, contact); err != nil {
+				log.Err(err).Msg("failed to merge duplicate contact")
+				return nil
+			}
+			log.Warn().Msg("merged new contact into existing duplicate contact and deleted it")
+			return &contactMerge{Base: &duplicate, Merged: contact, Match: query}
+		}
+	}
+	return nil
+}
+
+// mergeContactCommand is the private note command that agents can use to
+// merge another contact into the contact of the conversation. Since merging
+// deletes the other contact, the command has to be confirmed by repeating it
+// with the IDs of both contacts.
+const mergeContactCommand = "!merge-contact"
+
+// HandleMergeContactCommand handles the merge contact command if the private
+// note contains it. It returns whether the note was a command.
+func HandleMergeContactCommand(ctx context.Context, mc chatwootapi.MessageCreated) bool {
+	args, ok := strings.CutPrefix(strings.TrimSpace(mc.Content), mergeContactCommand)
+	if !ok || !configuration.ContactMerge.AgentCommand {
+		return false
+	}
+	log := zerolog.Ctx(ctx).With().Str("component", "merge_contact_command").Logger()
+	ctx = log.WithContext(ctx)
+
+	reply := func(note string) {
+		DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send merge contact reply to %d", mc.Conversation.ID), func(ctx context.Context) (*chatwootapi.Message, error) {
+			return chatwootAPI.SendPrivateMessage(ctx, mc.Conversation.ID, note)
+		})
+	}
+
+	baseContactID := mc.Conversation.Meta.Sender.ID
+	fields := strings.Fields(args)
+	var contactIDs []int
+	for _, field := range fields {
+		contactID, err := strconv.Atoi(field)
+		if err != nil || contactID <= 0 {
+			break
+		}
+		contactIDs = append(contactIDs, contactID)
+	}
+	if len(fields) == 0 || len(fields) > 2 || len(contactIDs) != len(fields) {
+		reply(fmt.Sprintf("**Usage:** `%s <contact ID>` merges the given contact into the contact of this conversation.", mergeContactCommand))
+		return true
+	}
+	mergeeContactID := contactIDs[0]
+	if chatwootapi.ContactID(mergeeContactID) == baseContactID {
+		reply("**Cannot merge the contact into itself.**")
+		return true
+	}
+	log = log.With().
+		Int("base_contact_id", int(baseContactID)).
+		Int("mergee_contact_id", mergeeContactID).
+		Logger()
+
+	mergee, err := chatwootAPI.GetContact(ctx, chatwootapi.ContactID(mergeeContactID))
+	if err != nil {
+		log.Err(err).Msg("failed to get mergee contact")
+		reply(fmt.Sprintf("**Failed to find contact %d:** %s", mergeeContactID, err))
+		return true
+	}
+
+	if len(contactIDs) == 1 {
+		reply(fmt.Sprintf("**This will merge contact %d (%s) into the contact of this conversation (%d) and delete contact %d. This cannot be undone.** To confirm, send `%s %d %d`.",
+			mergeeContactID, mergee.Identifier, baseContactID, mergeeContactID, mergeContactCommand, mergeeContactID, baseContactID))
+		return true
+	} else if chatwootapi.ContactID(contactIDs[1]) != baseContactID {
+		reply(fmt.Sprintf("**Contact %d is not the contact of this conversation (%d).** Nothing was merged.", contactIDs[1], baseContactID))
+		return true
+	}
+
+	if err = mergeContacts(ctx, baseContactID, mergee); err != nil {
+		log.Err(err).Msg("failed to merge contacts")
+		reply(fmt.Sprintf("**Failed to merge contact %d:** %s", mergeeContactID, err))
+		return true
+	}
+	log.Info().Msg("merged contacts")
+	reply(fmt.Sprintf("**Merged contact %d into the contact of this conversation.**", mergeeContactID))
+	return true
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/variationselector"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+	"github.com/beeper/chatwoot/database"
+)
+
+// csatRatingEmojis are the reactions that the bot adds to CSAT surveys. They
+// are the same emojis that Chatwoot uses on its own survey page, ordered from
+// a rating of 1 to a rating of 5.
+var csatRatingEmojis = []string{"😞", "😑", "😐", "😀", "😍"}
+
+// csatRatingKeycaps are also accepted as ratings when the customer reacts to
+// the survey.
+var csatRatingKeycaps = []string{"1️⃣", "2️⃣", "3️⃣", "4️⃣", "5️⃣"}
+
+// csatFeedbackWindow is how long after rating a reply to the survey is
+// treated as feedback for the survey.
+const csatFeedbackWindow = 1 * time.Hour
+
+// csatSurveyExpiry is how long after sending the survey a number from 1 to 5
+// is treated as the rating.
+const csatSurveyExpiry = 24 * time.Hour
+
+func csatRatingForReaction(key string) int {
+	key = variationselector.Remove(key)
+	for i := range csatRatingEmojis {
+		if key == variationselector.Remove(csatRatingEmojis[i]) || key == variationselector.Remove(csatRatingKeycaps[i]) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// sendCSATSurvey sends the CSAT survey message to the room and adds the rating
+// reactions to it so that the customer can answer with a single click.
+func sendCSATSurvey(ctx context.Context, roomID id.RoomID, mc chatwootapi.MessageCreated, senderName string) (*mautrix.RespSendEvent, error) {
+	log := zerolog.Ctx(ctx).With().Str("component", "send_csat_survey").Logger()
+	ctx = log.WithContext(ctx)
+
+	content, _ := renderInteractiveMessage(mc, senderName)
+	resp, err := SendMessage(ctx, roomID, content, map[string]any{
+		"com.beeper.chatwoot.message_id":   mc.ID,
+		"com.beeper.chatwoot.content_type": mc.ContentType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = stateStore.SetCSATSurveyForRoom(ctx, database.CSATSurvey{
+		RoomID:            roomID,
+		ConversationID:    mc.Conversation.ID,
+		ChatwootMessageID: mc.ID,
+		EventID:           resp.EventID,
+	})
+	if err != nil {
+		log.Err(err).Msg("failed to store CSAT survey")
+		return resp, nil
+	}
+
+	for _, emoji := range csatRatingEmojis {
+		_, err = client.SendReaction(ctx, roomID, resp.EventID, emoji)
+		if err != nil {
+			log.Warn().Err(err).Str("emoji", emoji).Msg("failed to add rating reaction to CSAT survey")
+		}
+	}
+	return resp, nil
+}
+
+func submitCSATResponse(ctx context.Context, survey *database.CSATSurvey, rating int, feedback string) error {
+	_, err := DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("submit CSAT response for conversation %d", survey.ConversationID), func(ctx context.Context) (*struct{}, error) {
+		conversation, err := chatwootAPI.GetChatwootConversation(ctx, survey.ConversationID)
+		if err != nil {
+			return nil, err
+		}
+		return &struct{}{}, chatwootAPI.SubmitCSATResponse(ctx, conversation.UUID, rating, feedback)
+	})
+	return err
+}
+
+func recordCSATRating(ctx context.Context, survey *database.CSATSurvey, rating int) error {
+	log := zerolog.Ctx(ctx).With().Int("rating", rating).Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Info().Msg("submitting CSAT rating")
+	if err := submitCSATResponse(ctx, survey, rating, ""); err != nil {
+		return err
+	}
+	if err := stateStore.SetCSATRatingForRoom(ctx, survey.RoomID, rating); err != nil {
+		log.Warn().Err(err).Msg("failed to store CSAT rating")
+	}
+
+	_, err := SendMessage(ctx, survey.RoomID, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    "Thank you for your rating! If you'd like to tell us more, reply to the survey with your feedback.",
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to send CSAT rating confirmation")
+	}
+	return nil
+}
+
+// handleCSATReaction handles a reaction to a CSAT survey. It returns whether
+// the reaction was consumed by the survey and should not be bridged.
+func handleCSATReaction(ctx context.Context, evt *event.Event) bool {
+	log := zerolog.Ctx(ctx).With().Str("component", "handle_csat_reaction").Logger()
+	ctx = log.WithContext(ctx)
+
+	reaction := evt.Content.AsReaction()
+	survey, err := stateStore.GetCSATSurveyForRoom(ctx, evt.RoomID)
+	if err != nil || survey.EventID != reaction.RelatesTo.EventID {
+		return false
+	} else if evt.Sender == configuration.Username {
+		// These are the rating options that the bot added itself.
+		return true
+	}
+
+	rating := csatRatingForReaction(reaction.RelatesTo.Key)
+	if rating == 0 {
+		return false
+	}
+
+	if err = recordCSATRating(ctx, survey, rating); err != nil {
+		log.Err(err).Msg("failed to record CSAT rating from reaction")
+		sendCSATErrorNote(ctx, survey, fmt.Sprintf("**Failed to submit the customer's CSAT rating of %d.**\n\nError: %+v", rating, err))
+	}
+	return true
+}
+
+// handleCSATReply handles a text message sent while a CSAT survey is pending
+// in the room. A number from 1 to 5 is treated as the rating until the survey
+// expires, and a reply to the survey after the rating is treated as feedback.
+// The message is bridged to the conversation regardless.
+func handleCSATReply(ctx context.Context, evt *event.Event, content *event.MessageEventContent) {
+	log := zerolog.Ctx(ctx).With().Str("component", "handle_csat_reply").Logger()
+	ctx = log.WithContext(ctx)
+
+	survey, err := stateStore.GetCSATSurveyForRoom(ctx, evt.RoomID)
+	if err != nil {
+		return
+	}
+
+	if survey.Rating == 0 {
+		if time.Since(survey.SentAt) > csatSurveyExpiry {
+			if err = stateStore.ClearCSATSurveyForRoom(ctx, evt.RoomID); err != nil {
+				log.Warn().Err(err).Msg("failed to clear expired CSAT survey")
+			}
+			return
+		}
+		rating, err := strconv.Atoi(strings.TrimSpace(event.TrimReplyFallbackText(content.Body)))
+		if err != nil || rating < 1 || rating > len(csatRatingEmojis) {
+			return
+		}
+		if err = recordCSATRating(ctx, survey, rating); err != nil {
+			log.Err(err).Msg("failed to record CSAT rating from reply")
+			sendCSATErrorNote(ctx, survey, fmt.Sprintf("**Failed to submit the customer's CSAT rating of %d.**\n\nError: %+v", rating, err))
+		}
+		return
+	}
+
+	if time.Since(survey.RatedAt) > csatFeedbackWindow {
+		if err = stateStore.ClearCSATSurveyForRoom(ctx, evt.RoomID); err != nil {
+			log.Warn().Err(err).Msg("failed to clear expired CSAT survey")
+		}
+		return
+	} else if content.RelatesTo.GetReplyTo() != survey.EventID {
+		return
+	}
+
+	log.Info().Msg("submitting CSAT feedback")
+	if err = submitCSATResponse(ctx, survey, survey.Rating, event.TrimReplyFallbackText(content.Body)); err != nil {
+		log.Err(err).Msg("failed to submit CSAT feedback")
+		sendCSATErrorNote(ctx, survey, fmt.Sprintf("**Failed to submit the customer's CSAT feedback.**\n\nError: %+v", err))
+		return
+	}
+	if err = stateStore.ClearCSATSurveyForRoom(ctx, evt.RoomID); err != nil {
+		log.Warn().Err(err).Msg("failed to clear CSAT survey")
+	}
+	_, err = SendMessage(ctx, evt.RoomID, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    "Thank you for your feedback!",
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to send CSAT feedback confirmation")
+	}
+}
+
+func sendCSATErrorNote(ctx context.Context, survey *database.CSATSurvey, note string) {
+	DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send private error message to %d", survey.ConversationID), func(ctx context.Context) (*chatwootapi.Message, error) {
+		return chatwootAPI.SendPrivateMessage(ctx, survey.ConversationID, note)
+	})
+}
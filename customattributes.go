@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+	"github.com/beeper/chatwoot/database"
+)
+
+// CustomAttributeSource is where the value of a mapped custom attribute comes
+// from. Some sources take an argument, which is separated from the source
+// name with a colon.
+type CustomAttributeSource string
+
+const (
+	// The value is always the default value.
+	CustomAttributeSourceNone CustomAttributeSource = ""
+
+	// Room state
+	CustomAttributeSourceRoomName  CustomAttributeSource = "room_name"
+	CustomAttributeSourceRoomTopic CustomAttributeSource = "room_topic"
+	// room_state:<event type>:<content key> uses a field of the room state
+	// event with the given type and an empty state key.
+	CustomAttributeSourceRoomState CustomAttributeSource = "room_state"
+
+	// Bridge info (m.bridge)
+	CustomAttributeSourceBridgeNetwork     CustomAttributeSource = "bridge_network"
+	CustomAttributeSourceBridgeNetworkName CustomAttributeSource = "bridge_network_name"
+	CustomAttributeSourceBridgeChannel     CustomAttributeSource = "bridge_channel"
+
+	// Member event of the customer
+	CustomAttributeSourceMemberDisplayname CustomAttributeSource = "member_displayname"
+	CustomAttributeSourceMemberUserID      CustomAttributeSource = "member_user_id"
+	CustomAttributeSourceMemberHomeserver  CustomAttributeSource = "member_homeserver"
+	// member_content:<content key> uses a field of the member event.
+	CustomAttributeSourceMemberContent CustomAttributeSource = "member_content"
+
+	// Client metadata of the latest message from the customer
+	CustomAttributeSourceClientType    CustomAttributeSource = "client_type"
+	CustomAttributeSourceClientVersion CustomAttributeSource = "client_version"
+)
+
+// customAttributeMapping is a CustomAttributeMapping with its source parsed.
+type customAttributeMapping struct {
+	CustomAttributeMapping
+	source CustomAttributeSource
+	args   []string
+}
+
+// fromState returns whether the value of the mapping comes from the room
+// state, which is only fetched when the conversation is created or the state
+// changes.
+func (m *customAttributeMapping) fromState() bool {
+	switch m.source {
+	case CustomAttributeSourceNone, CustomAttributeSourceMemberUserID, CustomAttributeSourceMemberHomeserver,
+		CustomAttributeSourceClientType, CustomAttributeSourceClientVersion:
+		return false
+	default:
+		return true
+	}
+}
+
+// customAttributeMappings are the custom attributes that are filled in on
+// conversations.
+var customAttributeMappings []*customAttributeMapping
+
+// NewCustomAttributeMappings validates the custom attribute mapping from the
+// configuration.
+func NewCustomAttributeMappings(mappings []CustomAttributeMapping) ([]*customAttributeMapping, error) {
+	var parsed []*customAttributeMapping
+	for i, mapping := range mappings {
+		if mapping.Attribute == "" {
+			return nil, fmt.Errorf("custom attribute mapping %d must have an attribute", i)
+		}
+		parts := strings.Split(mapping.Source, ":")
+		m := &customAttributeMapping{
+			CustomAttributeMapping: mapping,
+			source:                 CustomAttributeSource(parts[0]),
+			args:                   parts[1:],
+		}
+		expectedArgs := 0
+		switch m.source {
+		case CustomAttributeSourceNone, CustomAttributeSourceRoomName, CustomAttributeSourceRoomTopic,
+			CustomAttributeSourceBridgeNetwork, CustomAttributeSourceBridgeNetworkName, CustomAttributeSourceBridgeChannel,
+			CustomAttributeSourceMemberDisplayname, CustomAttributeSourceMemberUserID, CustomAttributeSourceMemberHomeserver,
+			CustomAttributeSourceClientType, CustomAttributeSourceClientVersion:
+		case CustomAttributeSourceMemberContent:
+			expectedArgs = 1
+		case CustomAttributeSourceRoomState:
+			expectedArgs = 2
+		default:
+			return nil, fmt.Errorf("unknown source %q in custom attribute mapping %d", mapping.Source, i)
+		}
+		if len(m.args) != expectedArgs {
+			return nil, fmt.Errorf("source %q in custom attribute mapping %d must have %d arguments", mapping.Source, i, expectedArgs)
+		}
+		parsed = append(parsed, m)
+	}
+	return parsed, nil
+}
+
+// stringField returns the field of the event content as a string.
+func stringField(content map[string]any, key string) string {
+	switch value := content[key].(type) {
+	case string:
+		return value
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// resolveFromState resolves the value of a mapping whose value comes from the
+// room state.
+func (m *customAttributeMapping) resolveFromState(state mautrix.RoomStateMap, userID id.UserID) string {
+	var bridge *event.BridgeEventContent
+	for _, bridgeType := range []event.Type{event.StateBridge, event.StateHalfShotBridge} {
+		for _, bridgeEvent := range state[bridgeType] {
+			bridge = bridgeEvent.Content.AsBridge()
+			break
+		}
+		if bridge != nil {
+			break
+		}
+	}
+	member := state[event.StateMember][userID.String()]
+
+	switch m.source {
+	case CustomAttributeSourceRoomName:
+		if evt, ok := state[event.StateRoomName][""]; ok {
+			return evt.Content.AsRoomName().Name
+		}
+	case CustomAttributeSourceRoomTopic:
+		if evt, ok := state[event.StateTopic][""]; ok {
+			return evt.Content.AsTopic().Topic
+		}
+	case CustomAttributeSourceRoomState:
+		evtType := event.Type{Type: m.args[0], Class: event.StateEventType}
+		if evt, ok := state[evtType][""]; ok {
+			return stringField(evt.Content.Raw, m.args[1])
+		}
+	case CustomAttributeSourceBridgeNetwork:
+		if bridge != nil {
+			return bridge.Protocol.ID
+		}
+	case CustomAttributeSourceBridgeNetworkName:
+		if bridge != nil {
+			return bridge.Protocol.DisplayName
+		}
+	case CustomAttributeSourceBridgeChannel:
+		if bridge != nil {
+			return bridge.Channel.DisplayName
+		}
+	case CustomAttributeSourceMemberDisplayname:
+		if member != nil {
+			return member.Content.AsMember().Displayname
+		}
+	case CustomAttributeSourceMemberContent:
+		if member != nil {
+			return stringField(member.Content.Raw, m.args[0])
+		}
+	}
+	return ""
+}
+
+// resolve resolves the value of a mapping whose value doesn't come from the
+// room state. It returns false if the value is not known.
+func (m *customAttributeMapping) resolve(userID id.UserID, evt *event.Event) (string, bool) {
+	switch m.source {
+	case CustomAttributeSourceNone:
+		return "", true
+	case CustomAttributeSourceMemberUserID:
+		return userID.String(), userID != ""
+	case CustomAttributeSourceMemberHomeserver:
+		return userID.Homeserver(), userID != ""
+	case CustomAttributeSourceClientType:
+		if evt != nil && evt.Type == event.EventMessage {
+			clientType, ok := evt.Content.Raw["com.beeper.origin_client_type"].(string)
+			return clientType, ok
+		}
+	case CustomAttributeSourceClientVersion:
+		if evt != nil && evt.Type == event.EventMessage {
+			clientVersion, ok := evt.Content.Raw["com.beeper.origin_client_version"].(string)
+			return clientVersion, ok
+		}
+	}
+	return "", false
+}
+
+// resolveCustomAttributes resolves the values of the mappings. If the state is
+// nil, the values that come from the room state are taken from the previous
+// values. Empty values are replaced with the default value of the mapping.
+func resolveCustomAttributes(mappings []*customAttributeMapping, previous map[string]string, state mautrix.RoomStateMap, userID id.UserID, evt *event.Event) map[string]string {
+	values := map[string]string{}
+	for _, mapping := range mappings {
+		var value string
+		if mapping.fromState() {
+			if state != nil {
+				value = mapping.resolveFromState(state, userID)
+			} else {
+				value = previous[mapping.Attribute]
+			}
+		} else if resolved, ok := mapping.resolve(userID, evt); ok {
+			value = resolved
+		} else {
+			value = previous[mapping.Attribute]
+		}
+		if value == "" {
+			value = mapping.Default
+		}
+		values[mapping.Attribute] = value
+	}
+	return values
+}
+
+// mergeCustomAttributes returns the custom attributes to set on a conversation
+// with the current custom attributes. Setting the custom attributes replaces
+// all of them, so only the mapped attributes are kept, and attributes that
+// aren't mapped are removed.
+func mergeCustomAttributes(mappings []*customAttributeMapping, values, current map[string]string) map[string]string {
+	customAttributes := map[string]string{}
+	for _, mapping := range mappings {
+		// Unless the mapping overwrites values, only fill in attributes that
+		// haven't been set (for example, by an agent) yet.
+		if value := current[mapping.Attribute]; mapping.Overwrite || value == "" {
+			customAttributes[mapping.Attribute] = values[mapping.Attribute]
+		} else {
+			customAttributes[mapping.Attribute] = value
+		}
+	}
+	return customAttributes
+}
+
+// UpdateCustomAttributes fills in the mapped custom attributes of the
+// conversation. The values that come from the room state are only resolved
+// when the conversation doesn't have mapped values yet or when the room state
+// is given (because it changed or was already fetched). The conversation is
+// only updated if any of the values changed.
+//
+// The event is the message or state event that triggered the update. Messages
+// from the customer update the client metadata.
+func UpdateCustomAttributes(ctx context.Context, conversationID chatwootapi.ConversationID, roomID id.RoomID, evt *event.Event, state mautrix.RoomStateMap) {
+	if len(customAttributeMappings) == 0 {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "update_custom_attributes").
+		Int("conversation_id", int(conversationID)).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	previous, err := stateStore.GetConversationCustomAttributes(ctx, conversationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		previous = &database.ConversationCustomAttributes{}
+		if state == nil {
+			state, err = client.State(ctx, roomID)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to get room state, using default values")
+				state = nil
+			}
+		}
+	} else if err != nil {
+		log.Err(err).Msg("failed to get previous custom attributes")
+		return
+	}
+
+	userID := previous.UserID
+	if evt != nil && evt.Type == event.EventMessage && evt.Sender != configuration.Username {
+		userID = evt.Sender
+	}
+	values := resolveCustomAttributes(customAttributeMappings, previous.Attributes, state, userID, evt)
+
+	if previous.Attributes != nil && previous.UserID == userID && maps.Equal(previous.Attributes, values) {
+		return
+	}
+
+	conversation, err := chatwootAPI.GetChatwootConversation(ctx, conversationID)
+	if err != nil {
+		log.Err(err).Msg("failed to get conversation to update custom attributes")
+		return
+	}
+	customAttributes := mergeCustomAttributes(customAttributeMappings, values, conversation.CustomAttributes)
+
+	if !maps.Equal(customAttributes, conversation.CustomAttributes) {
+		log.Info().Any("custom_attributes", customAttributes).Msg("updating conversation custom attributes")
+		if err := chatwootAPI.SetConversationCustomAttributes(ctx, conversationID, customAttributes); err != nil {
+			log.Err(err).Msg("failed to set conversation custom attributes")
+			return
+		}
+	}
+	err = stateStore.SetConversationCustomAttributes(ctx, conversationID, database.ConversationCustomAttributes{
+		UserID:     userID,
+		Attributes: values,
+	})
+	if err != nil {
+		log.Err(err).Msg("failed to store conversation custom attributes")
+	}
+}
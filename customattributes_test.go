@@ -0,0 +1,122 @@
+package main
+
+import (
+	"maps"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestResolveCustomAttributes(t *testing.T) {
+	mappings, err := NewCustomAttributeMappings([]CustomAttributeMapping{
+		{Attribute: "tier", Default: "standard"},
+		{Attribute: "plan", Source: "room_state:com.example.account:plan", Default: "free"},
+		{Attribute: "network", Source: "bridge_network_name"},
+		{Attribute: "nickname", Source: "member_displayname"},
+		{Attribute: "company", Source: "member_content:com.example.company"},
+		{Attribute: "homeserver", Source: "member_homeserver"},
+		{Attribute: "client", Source: "client_type", Default: "unknown"},
+	})
+	if err != nil {
+		t.Fatalf("NewCustomAttributeMappings: %v", err)
+	}
+
+	customer := id.UserID("@whatsapp_123:beeper.local")
+	accountType := event.Type{Type: "com.example.account", Class: event.StateEventType}
+	state := testRoom("Alice", "whatsapp", "WhatsApp", customer)
+	state[event.StateMember][customer.String()] = &event.Event{Content: event.Content{
+		Raw:    map[string]any{"com.example.company": "ACME"},
+		Parsed: &event.MemberEventContent{Membership: event.MembershipJoin, Displayname: "Alice"},
+	}}
+
+	expect := func(t *testing.T, values map[string]string, expected map[string]string) {
+		t.Helper()
+		if !maps.Equal(values, expected) {
+			t.Errorf("values = %v\nexpected %v", values, expected)
+		}
+	}
+
+	// The conversation is created with the room state.
+	values := resolveCustomAttributes(mappings, nil, state, customer, testMessage(customer, "hi", "ios", ""))
+	expect(t, values, map[string]string{
+		"tier":       "standard",
+		"plan":       "free",
+		"network":    "WhatsApp",
+		"nickname":   "Alice",
+		"company":    "ACME",
+		"homeserver": "beeper.local",
+		"client":     "ios",
+	})
+
+	// Later messages don't refresh the values from the room state, but they
+	// update the client metadata.
+	state[event.StateMember][customer.String()].Content.Parsed.(*event.MemberEventContent).Displayname = "Alice Smith"
+	values = resolveCustomAttributes(mappings, values, nil, customer, testMessage(customer, "hello", "android", ""))
+	expect(t, values, map[string]string{
+		"tier":       "standard",
+		"plan":       "free",
+		"network":    "WhatsApp",
+		"nickname":   "Alice",
+		"company":    "ACME",
+		"homeserver": "beeper.local",
+		"client":     "android",
+	})
+
+	// A state change refreshes the values from the room state. It doesn't
+	// carry client metadata, so the previous client type is kept.
+	state[accountType] = map[string]*event.Event{
+		"": {Content: event.Content{Raw: map[string]any{"plan": "pro"}}},
+	}
+	values = resolveCustomAttributes(mappings, values, state, customer, &event.Event{Type: accountType})
+	expect(t, values, map[string]string{
+		"tier":       "standard",
+		"plan":       "pro",
+		"network":    "WhatsApp",
+		"nickname":   "Alice Smith",
+		"company":    "ACME",
+		"homeserver": "beeper.local",
+		"client":     "android",
+	})
+
+	// If the room state couldn't be fetched for a new conversation, the
+	// defaults are used.
+	values = resolveCustomAttributes(mappings, nil, nil, customer, nil)
+	expect(t, values, map[string]string{
+		"tier":       "standard",
+		"plan":       "free",
+		"network":    "",
+		"nickname":   "",
+		"company":    "",
+		"homeserver": "beeper.local",
+		"client":     "unknown",
+	})
+}
+
+func TestMergeCustomAttributes(t *testing.T) {
+	mappings, err := NewCustomAttributeMappings([]CustomAttributeMapping{
+		{Attribute: "network", Source: "bridge_network"},
+		{Attribute: "client", Source: "client_type", Overwrite: true},
+		{Attribute: "reason", Default: "support"},
+	})
+	if err != nil {
+		t.Fatalf("NewCustomAttributeMappings: %v", err)
+	}
+	values := map[string]string{"network": "whatsapp", "client": "ios", "reason": "support"}
+
+	// The first update fills in every mapped attribute.
+	merged := mergeCustomAttributes(mappings, values, nil)
+	if !maps.Equal(merged, values) {
+		t.Errorf("merged into empty attributes = %v, expected %v", merged, values)
+	}
+
+	// An agent changed the network and reason and added a note, and the
+	// customer switched clients.
+	current := map[string]string{"network": "signal", "client": "ios", "reason": "billing", "note": "call back"}
+	values["client"] = "android"
+	merged = mergeCustomAttributes(mappings, values, current)
+	expected := map[string]string{"network": "signal", "client": "android", "reason": "billing"}
+	if !maps.Equal(merged, expected) {
+		t.Errorf("merged = %v, expected %v", merged, expected)
+	}
+}
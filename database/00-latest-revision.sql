@@ -1,4 +1,4 @@
--- v0 -> v2: Latest revision
+-- v0 -> v15: Latest revision
 
 CREATE TABLE IF NOT EXISTS user_filter_ids (
 	user_id    TEXT PRIMARY KEY,
@@ -25,6 +25,7 @@ CREATE TABLE IF NOT EXISTS chatwoot_conversation_to_matrix_room (
 	matrix_room_id            TEXT     UNIQUE,
 	chatwoot_conversation_id  INTEGER  UNIQUE,
 	most_recent_event_id      TEXT,
+	last_activity_ts          BIGINT,
 	PRIMARY KEY (matrix_room_id, chatwoot_conversation_id)
 );
 
@@ -33,3 +34,92 @@ CREATE TABLE IF NOT EXISTS chatwoot_message_to_matrix_event (
 	chatwoot_message_id  INTEGER,
 	PRIMARY KEY (matrix_event_id, chatwoot_message_id)
 );
+
+CREATE TABLE IF NOT EXISTS chatwoot_pending_input (
+	matrix_room_id       TEXT     PRIMARY KEY,
+	chatwoot_message_id  INTEGER  NOT NULL,
+	content_type         TEXT     NOT NULL,
+	options              TEXT     NOT NULL,
+	created_at           BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS chatwoot_csat_survey (
+	matrix_room_id            TEXT     PRIMARY KEY,
+	chatwoot_conversation_id  INTEGER  NOT NULL,
+	chatwoot_message_id       INTEGER  NOT NULL,
+	matrix_event_id           TEXT     NOT NULL,
+	rating                    INTEGER,
+	rated_at                  BIGINT,
+	sent_at                   BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS matrix_poll_response (
+	poll_event_id  TEXT    NOT NULL,
+	user_id        TEXT    NOT NULL,
+	answers        TEXT    NOT NULL,
+	timestamp      BIGINT  NOT NULL,
+	PRIMARY KEY (poll_event_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS matrix_undecryptable_event (
+	event_id    TEXT    PRIMARY KEY,
+	room_id     TEXT    NOT NULL,
+	session_id  TEXT    NOT NULL,
+	event_json  TEXT    NOT NULL,
+	timestamp   BIGINT  NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS matrix_undecryptable_event_session_idx ON matrix_undecryptable_event (room_id, session_id);
+
+CREATE TABLE IF NOT EXISTS chatwoot_contact_profile (
+	chatwoot_contact_id  INTEGER  PRIMARY KEY,
+	matrix_user_id       TEXT     NOT NULL,
+	matrix_room_id       TEXT     NOT NULL,
+	name                 TEXT     NOT NULL,
+	avatar_mxc           TEXT     NOT NULL,
+	phone_number         TEXT     NOT NULL,
+	email                TEXT     NOT NULL,
+	bridge_protocol      TEXT     NOT NULL,
+	bridge_identifiers   TEXT     NOT NULL,
+	refreshed_at         BIGINT   NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS chatwoot_contact_alias (
+	identifier           TEXT     PRIMARY KEY,
+	chatwoot_contact_id  INTEGER  NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS chatwoot_contact_identifier (
+	identifier           TEXT     PRIMARY KEY,
+	chatwoot_contact_id  INTEGER  NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS chatwoot_conversation_custom_attributes (
+	chatwoot_conversation_id  INTEGER  PRIMARY KEY,
+	matrix_user_id            TEXT     NOT NULL,
+	attributes                TEXT     NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS chatwoot_pending_label (
+	chatwoot_conversation_id  INTEGER  NOT NULL,
+	label                     TEXT     NOT NULL,
+	apply_at                  BIGINT   NOT NULL,
+
+	PRIMARY KEY (chatwoot_conversation_id, label)
+);
+
+CREATE TABLE IF NOT EXISTS matrix_room_upgrade (
+	old_room_id               TEXT     PRIMARY KEY,
+	new_room_id               TEXT     NOT NULL,
+	chatwoot_conversation_id  INTEGER  NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS matrix_room_upgrade_conversation_idx ON matrix_room_upgrade (chatwoot_conversation_id);
+
+CREATE TABLE IF NOT EXISTS matrix_room_cleanup (
+	matrix_room_id            TEXT     PRIMARY KEY,
+	chatwoot_conversation_id  INTEGER  NOT NULL,
+	reason                    TEXT     NOT NULL,
+	forgotten                 BOOLEAN  NOT NULL,
+	cleaned_up_at             BIGINT   NOT NULL
+);
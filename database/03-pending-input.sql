@@ -0,0 +1,8 @@
+-- v3: Add table for pending interactive message inputs
+
+CREATE TABLE chatwoot_pending_input (
+	matrix_room_id       TEXT     PRIMARY KEY,
+	chatwoot_message_id  INTEGER  NOT NULL,
+	content_type         TEXT     NOT NULL,
+	options              TEXT     NOT NULL
+);
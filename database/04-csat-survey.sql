@@ -0,0 +1,10 @@
+-- v4: Add table for CSAT surveys sent to Matrix rooms
+
+CREATE TABLE chatwoot_csat_survey (
+	matrix_room_id            TEXT     PRIMARY KEY,
+	chatwoot_conversation_id  INTEGER  NOT NULL,
+	chatwoot_message_id       INTEGER  NOT NULL,
+	matrix_event_id           TEXT     NOT NULL,
+	rating                    INTEGER,
+	rated_at                  BIGINT
+);
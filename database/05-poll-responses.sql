@@ -0,0 +1,9 @@
+-- v5: Add table for Matrix poll responses
+
+CREATE TABLE matrix_poll_response (
+	poll_event_id  TEXT    NOT NULL,
+	user_id        TEXT    NOT NULL,
+	answers        TEXT    NOT NULL,
+	timestamp      BIGINT  NOT NULL,
+	PRIMARY KEY (poll_event_id, user_id)
+);
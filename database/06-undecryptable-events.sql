@@ -0,0 +1,11 @@
+-- v6: Add table for Matrix events that could not be decrypted
+
+CREATE TABLE matrix_undecryptable_event (
+	event_id    TEXT    PRIMARY KEY,
+	room_id     TEXT    NOT NULL,
+	session_id  TEXT    NOT NULL,
+	event_json  TEXT    NOT NULL,
+	timestamp   BIGINT  NOT NULL
+);
+
+CREATE INDEX matrix_undecryptable_event_session_idx ON matrix_undecryptable_event (room_id, session_id);
@@ -0,0 +1,14 @@
+-- v7: Add table for the Matrix profiles that Chatwoot contacts were enriched with
+
+CREATE TABLE chatwoot_contact_profile (
+	chatwoot_contact_id  INTEGER  PRIMARY KEY,
+	matrix_user_id       TEXT     NOT NULL,
+	matrix_room_id       TEXT     NOT NULL,
+	name                 TEXT     NOT NULL,
+	avatar_mxc           TEXT     NOT NULL,
+	phone_number         TEXT     NOT NULL,
+	email                TEXT     NOT NULL,
+	bridge_protocol      TEXT     NOT NULL,
+	bridge_identifiers   TEXT     NOT NULL,
+	refreshed_at         BIGINT   NOT NULL
+);
@@ -0,0 +1,6 @@
+-- v8: Add table for the identifiers of merged Chatwoot contacts
+
+CREATE TABLE chatwoot_contact_alias (
+	identifier           TEXT     PRIMARY KEY,
+	chatwoot_contact_id  INTEGER  NOT NULL
+);
@@ -0,0 +1,6 @@
+-- v9: Add table for caching the contact IDs of contact identifiers
+
+CREATE TABLE chatwoot_contact_identifier (
+	identifier           TEXT     PRIMARY KEY,
+	chatwoot_contact_id  INTEGER  NOT NULL
+);
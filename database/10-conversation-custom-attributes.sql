@@ -0,0 +1,7 @@
+-- v10: Add table for the mapped custom attributes of Chatwoot conversations
+
+CREATE TABLE chatwoot_conversation_custom_attributes (
+	chatwoot_conversation_id  INTEGER  PRIMARY KEY,
+	matrix_user_id            TEXT     NOT NULL,
+	attributes                TEXT     NOT NULL
+);
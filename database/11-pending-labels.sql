@@ -0,0 +1,9 @@
+-- v11: Add table for labels that are waiting to be added to conversations
+
+CREATE TABLE chatwoot_pending_label (
+	chatwoot_conversation_id  INTEGER  NOT NULL,
+	label                     TEXT     NOT NULL,
+	apply_at                  BIGINT   NOT NULL,
+
+	PRIMARY KEY (chatwoot_conversation_id, label)
+);
@@ -0,0 +1,9 @@
+-- v12: Add table for Matrix rooms that were upgraded to a new room
+
+CREATE TABLE matrix_room_upgrade (
+	old_room_id               TEXT     PRIMARY KEY,
+	new_room_id               TEXT     NOT NULL,
+	chatwoot_conversation_id  INTEGER  NOT NULL
+);
+
+CREATE INDEX matrix_room_upgrade_conversation_idx ON matrix_room_upgrade (chatwoot_conversation_id);
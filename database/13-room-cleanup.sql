@@ -0,0 +1,14 @@
+-- v13: Add room activity timestamps and table for rooms that were cleaned up
+
+ALTER TABLE chatwoot_conversation_to_matrix_room ADD COLUMN last_activity_ts BIGINT;
+
+-- Existing rooms are considered active as of the upgrade.
+UPDATE chatwoot_conversation_to_matrix_room SET last_activity_ts = (EXTRACT(EPOCH FROM NOW()) * 1000)::BIGINT;
+
+CREATE TABLE matrix_room_cleanup (
+	matrix_room_id            TEXT     PRIMARY KEY,
+	chatwoot_conversation_id  INTEGER  NOT NULL,
+	reason                    TEXT     NOT NULL,
+	forgotten                 BOOLEAN  NOT NULL,
+	cleaned_up_at             BIGINT   NOT NULL
+);
@@ -0,0 +1,6 @@
+-- v14: Add the time that CSAT surveys were sent, so that they can expire
+
+ALTER TABLE chatwoot_csat_survey ADD COLUMN sent_at BIGINT;
+
+-- Existing surveys are considered sent as of the upgrade.
+UPDATE chatwoot_csat_survey SET sent_at = (EXTRACT(EPOCH FROM NOW()) * 1000)::BIGINT;
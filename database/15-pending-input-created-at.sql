@@ -0,0 +1,6 @@
+-- v15: Add the time that pending inputs were created, so that they can expire
+
+ALTER TABLE chatwoot_pending_input ADD COLUMN created_at BIGINT;
+
+-- Existing pending inputs are considered created as of the upgrade.
+UPDATE chatwoot_pending_input SET created_at = (EXTRACT(EPOCH FROM NOW()) * 1000)::BIGINT;
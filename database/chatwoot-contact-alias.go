@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// GetContactIDForAlias returns the ID of the contact that the contact with the
+// given identifier was merged into.
+func (store *Database) GetContactIDForAlias(ctx context.Context, identifier string) (contactID chatwootapi.ContactID, err error) {
+	row := store.DB.QueryRow(ctx, `
+		SELECT chatwoot_contact_id
+		  FROM chatwoot_contact_alias
+		 WHERE identifier = $1`, identifier)
+	err = row.Scan(&contactID)
+	return
+}
+
+// MergeContactAliases records that the mergee contact was merged into the base
+// contact. The identifiers of the mergee contact, and all of the identifiers
+// that were previously merged into it, become aliases of the base contact.
+func (store *Database) MergeContactAliases(ctx context.Context, baseContactID, mergeeContactID chatwootapi.ContactID, identifiers []string) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "merge_contact_aliases").
+		Int("base_contact_id", int(baseContactID)).
+		Int("mergee_contact_id", int(mergeeContactID)).
+		Strs("identifiers", identifiers).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Debug().Msg("merging contact aliases")
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, identifier := range identifiers {
+			_, err := store.DB.Exec(ctx, `
+				INSERT INTO chatwoot_contact_alias (identifier, chatwoot_contact_id)
+					VALUES ($1, $2)
+				ON CONFLICT (identifier) DO UPDATE
+					SET chatwoot_contact_id = $2
+			`, identifier, baseContactID)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := store.DB.Exec(ctx, `
+			UPDATE chatwoot_contact_alias
+			   SET chatwoot_contact_id = $1
+			 WHERE chatwoot_contact_id = $2
+		`, baseContactID, mergeeContactID)
+		if err != nil {
+			return err
+		}
+		_, err = store.DB.Exec(ctx, `
+			UPDATE chatwoot_contact_identifier
+			   SET chatwoot_contact_id = $1
+			 WHERE chatwoot_contact_id = $2
+		`, baseContactID, mergeeContactID)
+		if err != nil {
+			return err
+		}
+		// The mergee contact no longer exists, so its profile can't be
+		// refreshed anymore.
+		_, err = store.DB.Exec(ctx, "DELETE FROM chatwoot_contact_profile WHERE chatwoot_contact_id = $1", mergeeContactID)
+		return err
+	})
+}
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// GetCachedContactID returns the cached ID of the contact with the given
+// identifier.
+func (store *Database) GetCachedContactID(ctx context.Context, identifier string) (contactID chatwootapi.ContactID, err error) {
+	row := store.DB.QueryRow(ctx, `
+		SELECT chatwoot_contact_id
+		  FROM chatwoot_contact_identifier
+		 WHERE identifier = $1`, identifier)
+	err = row.Scan(&contactID)
+	return
+}
+
+func (store *Database) SetCachedContactID(ctx context.Context, identifier string, contactID chatwootapi.ContactID) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "set_cached_contact_id").
+		Str("identifier", identifier).
+		Int("contact_id", int(contactID)).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Debug().Msg("caching contact ID")
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		upsert := `
+			INSERT INTO chatwoot_contact_identifier (identifier, chatwoot_contact_id)
+				VALUES ($1, $2)
+			ON CONFLICT (identifier) DO UPDATE
+				SET chatwoot_contact_id = $2
+		`
+		_, err := store.DB.Exec(ctx, upsert, identifier, contactID)
+		return err
+	})
+}
+
+// DeleteCachedContactID removes the cached contact ID of the identifier, for
+// example because the contact was deleted in Chatwoot.
+func (store *Database) DeleteCachedContactID(ctx context.Context, identifier string) error {
+	_, err := store.DB.Exec(ctx, "DELETE FROM chatwoot_contact_identifier WHERE identifier = $1", identifier)
+	return err
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// ContactProfile is the Matrix profile and bridge information that a Chatwoot
+// contact was last enriched with.
+type ContactProfile struct {
+	ContactID         chatwootapi.ContactID
+	UserID            id.UserID
+	RoomID            id.RoomID
+	Name              string
+	AvatarMXC         id.ContentURIString
+	PhoneNumber       string
+	Email             string
+	BridgeProtocol    string
+	BridgeIdentifiers []string
+	RefreshedAt       time.Time
+}
+
+// Equal returns whether the profile information (but not the refresh time)
+// is the same.
+func (p *ContactProfile) Equal(other *ContactProfile) bool {
+	return p.Name == other.Name &&
+		p.AvatarMXC == other.AvatarMXC &&
+		p.PhoneNumber == other.PhoneNumber &&
+		p.Email == other.Email &&
+		p.BridgeProtocol == other.BridgeProtocol &&
+		slices.Equal(p.BridgeIdentifiers, other.BridgeIdentifiers)
+}
+
+func (store *Database) SetContactProfile(ctx context.Context, profile ContactProfile) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "set_contact_profile").
+		Int("contact_id", int(profile.ContactID)).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	identifiers, err := json.Marshal(profile.BridgeIdentifiers)
+	if err != nil {
+		return fmt.Errorf("failed to marshal bridge identifiers: %w", err)
+	}
+
+	log.Debug().Msg("setting contact profile")
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		upsert := `
+			INSERT INTO chatwoot_contact_profile (chatwoot_contact_id, matrix_user_id, matrix_room_id, name, avatar_mxc, phone_number, email, bridge_protocol, bridge_identifiers, refreshed_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT (chatwoot_contact_id) DO UPDATE
+				SET matrix_user_id = $2, matrix_room_id = $3, name = $4, avatar_mxc = $5, phone_number = $6,
+					email = $7, bridge_protocol = $8, bridge_identifiers = $9, refreshed_at = $10
+		`
+		_, err := store.DB.Exec(ctx, upsert,
+			profile.ContactID, profile.UserID, profile.RoomID, profile.Name, profile.AvatarMXC, profile.PhoneNumber,
+			profile.Email, profile.BridgeProtocol, string(identifiers), profile.RefreshedAt.UnixMilli())
+		return err
+	})
+}
+
+const contactProfileColumns = `
+	chatwoot_contact_id, matrix_user_id, matrix_room_id, name, avatar_mxc, phone_number, email, bridge_protocol, bridge_identifiers, refreshed_at
+`
+
+func scanContactProfile(row dbutil.Scannable) (*ContactProfile, error) {
+	var profile ContactProfile
+	var identifiers string
+	var refreshedAt int64
+	err := row.Scan(&profile.ContactID, &profile.UserID, &profile.RoomID, &profile.Name, &profile.AvatarMXC,
+		&profile.PhoneNumber, &profile.Email, &profile.BridgeProtocol, &identifiers, &refreshedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(identifiers), &profile.BridgeIdentifiers); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal bridge identifiers: %w", err)
+	}
+	profile.RefreshedAt = time.UnixMilli(refreshedAt)
+	return &profile, nil
+}
+
+func (store *Database) GetContactProfile(ctx context.Context, contactID chatwootapi.ContactID) (*ContactProfile, error) {
+	return scanContactProfile(store.DB.QueryRow(ctx, `
+		SELECT `+contactProfileColumns+`
+		  FROM chatwoot_contact_profile
+		 WHERE chatwoot_contact_id = $1`, contactID))
+}
+
+// GetContactProfilesRefreshedBefore returns the contact profiles that haven't
+// been refreshed since the given time.
+func (store *Database) GetContactProfilesRefreshedBefore(ctx context.Context, before time.Time) ([]*ContactProfile, error) {
+	rows, err := store.DB.Query(ctx, `
+		SELECT `+contactProfileColumns+`
+		  FROM chatwoot_contact_profile
+		 WHERE refreshed_at < $1`, before.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var profiles []*ContactProfile
+	for rows.Next() {
+		profile, err := scanContactProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, rows.Err()
+}
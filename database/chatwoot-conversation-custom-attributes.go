@@ -0,0 +1,61 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// ConversationCustomAttributes are the custom attribute values that were last
+// applied to a conversation by the custom attribute mapping, and the Matrix
+// user that they were resolved for.
+type ConversationCustomAttributes struct {
+	UserID     id.UserID
+	Attributes map[string]string
+}
+
+func (store *Database) SetConversationCustomAttributes(ctx context.Context, conversationID chatwootapi.ConversationID, attrs ConversationCustomAttributes) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "set_conversation_custom_attributes").
+		Int("conversation_id", int(conversationID)).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	attributes, err := json.Marshal(attrs.Attributes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal custom attributes: %w", err)
+	}
+
+	log.Debug().Msg("setting conversation custom attributes")
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		upsert := `
+			INSERT INTO chatwoot_conversation_custom_attributes (chatwoot_conversation_id, matrix_user_id, attributes)
+				VALUES ($1, $2, $3)
+			ON CONFLICT (chatwoot_conversation_id) DO UPDATE
+				SET matrix_user_id = $2, attributes = $3
+		`
+		_, err := store.DB.Exec(ctx, upsert, conversationID, attrs.UserID, string(attributes))
+		return err
+	})
+}
+
+func (store *Database) GetConversationCustomAttributes(ctx context.Context, conversationID chatwootapi.ConversationID) (*ConversationCustomAttributes, error) {
+	row := store.DB.QueryRow(ctx, `
+		SELECT matrix_user_id, attributes
+		  FROM chatwoot_conversation_custom_attributes
+		 WHERE chatwoot_conversation_id = $1`, conversationID)
+	var attrs ConversationCustomAttributes
+	var attributes string
+	if err := row.Scan(&attrs.UserID, &attributes); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(attributes), &attrs.Attributes); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal custom attributes: %w", err)
+	}
+	return &attrs, nil
+}
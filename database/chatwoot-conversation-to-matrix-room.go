@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/id"
@@ -11,11 +12,18 @@ import (
 	"github.com/beeper/chatwoot/chatwootapi"
 )
 
+// GetChatwootConversationIDFromMatrixRoom returns the conversation of the
+// room. Rooms that were upgraded still resolve to the conversation, so that
+// late events in the old room are bridged to it.
 func (store *Database) GetChatwootConversationIDFromMatrixRoom(ctx context.Context, roomID id.RoomID) (chatwootapi.ConversationID, error) {
 	row := store.DB.QueryRow(ctx, `
 		SELECT chatwoot_conversation_id
 		  FROM chatwoot_conversation_to_matrix_room
-		 WHERE matrix_room_id = $1`, roomID)
+		 WHERE matrix_room_id = $1
+		UNION ALL
+		SELECT chatwoot_conversation_id
+		  FROM matrix_room_upgrade
+		 WHERE old_room_id = $1`, roomID)
 	var chatwootConversationID chatwootapi.ConversationID
 	if err := row.Scan(&chatwootConversationID); err != nil {
 		return -1, err
@@ -51,10 +59,10 @@ func (store *Database) UpdateMostRecentEventIDForRoom(ctx context.Context, roomI
 	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
 		update := `
 			UPDATE chatwoot_conversation_to_matrix_room
-			SET most_recent_event_id = $2
+			SET most_recent_event_id = $2, last_activity_ts = $3
 			WHERE matrix_room_id = $1
 		`
-		if _, err := store.DB.Exec(ctx, update, roomID, mostRecentEventID); err != nil {
+		if _, err := store.DB.Exec(ctx, update, roomID, mostRecentEventID, time.Now().UnixMilli()); err != nil {
 			return fmt.Errorf("failed to update most recent event ID: %w", err)
 		}
 		return nil
@@ -71,12 +79,12 @@ func (store *Database) UpdateConversationIDForRoom(ctx context.Context, roomID i
 	log.Debug().Msg("setting conversation ID for room")
 	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
 		upsert := `
-			INSERT INTO chatwoot_conversation_to_matrix_room (matrix_room_id, chatwoot_conversation_id)
-				VALUES ($1, $2)
+			INSERT INTO chatwoot_conversation_to_matrix_room (matrix_room_id, chatwoot_conversation_id, last_activity_ts)
+				VALUES ($1, $2, $3)
 			ON CONFLICT (matrix_room_id) DO UPDATE
-				SET chatwoot_conversation_id = $2
+				SET chatwoot_conversation_id = $2, last_activity_ts = $3
 		`
-		_, err := store.DB.Exec(ctx, upsert, roomID, conversationID)
+		_, err := store.DB.Exec(ctx, upsert, roomID, conversationID, time.Now().UnixMilli())
 		return err
 	})
 }
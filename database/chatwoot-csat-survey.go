@@ -0,0 +1,91 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// CSATSurvey is a Chatwoot CSAT survey that was sent to a Matrix room and is
+// waiting for the customer's rating or feedback.
+type CSATSurvey struct {
+	RoomID            id.RoomID
+	ConversationID    chatwootapi.ConversationID
+	ChatwootMessageID chatwootapi.MessageID
+	EventID           id.EventID
+	Rating            int
+	RatedAt           time.Time
+	SentAt            time.Time
+}
+
+func (store *Database) SetCSATSurveyForRoom(ctx context.Context, survey CSATSurvey) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "set_csat_survey_for_room").
+		Int("conversation_id", int(survey.ConversationID)).
+		Stringer("survey_event_id", survey.EventID).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Debug().Msg("setting CSAT survey for room")
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		upsert := `
+			INSERT INTO chatwoot_csat_survey (matrix_room_id, chatwoot_conversation_id, chatwoot_message_id, matrix_event_id, rating, rated_at, sent_at)
+				VALUES ($1, $2, $3, $4, NULL, NULL, $5)
+			ON CONFLICT (matrix_room_id) DO UPDATE
+				SET chatwoot_conversation_id = $2, chatwoot_message_id = $3, matrix_event_id = $4, rating = NULL, rated_at = NULL, sent_at = $5
+		`
+		_, err := store.DB.Exec(ctx, upsert, survey.RoomID, survey.ConversationID, survey.ChatwootMessageID, survey.EventID, time.Now().UnixMilli())
+		return err
+	})
+}
+
+func (store *Database) GetCSATSurveyForRoom(ctx context.Context, roomID id.RoomID) (*CSATSurvey, error) {
+	row := store.DB.QueryRow(ctx, `
+		SELECT chatwoot_conversation_id, chatwoot_message_id, matrix_event_id, rating, rated_at, sent_at
+		  FROM chatwoot_csat_survey
+		 WHERE matrix_room_id = $1`, roomID)
+	survey := CSATSurvey{RoomID: roomID}
+	var rating, ratedAt, sentAt sql.NullInt64
+	if err := row.Scan(&survey.ConversationID, &survey.ChatwootMessageID, &survey.EventID, &rating, &ratedAt, &sentAt); err != nil {
+		return nil, err
+	}
+	if rating.Valid {
+		survey.Rating = int(rating.Int64)
+	}
+	if ratedAt.Valid {
+		survey.RatedAt = time.UnixMilli(ratedAt.Int64)
+	}
+	if sentAt.Valid {
+		survey.SentAt = time.UnixMilli(sentAt.Int64)
+	}
+	return &survey, nil
+}
+
+func (store *Database) SetCSATRatingForRoom(ctx context.Context, roomID id.RoomID, rating int) error {
+	_, err := store.DB.Exec(ctx, `
+		UPDATE chatwoot_csat_survey
+		   SET rating = $2, rated_at = $3
+		 WHERE matrix_room_id = $1`, roomID, rating, time.Now().UnixMilli())
+	return err
+}
+
+// ClearCSATSurveyForConversation removes the survey of the conversation, for
+// example because the conversation was reopened.
+func (store *Database) ClearCSATSurveyForConversation(ctx context.Context, conversationID chatwootapi.ConversationID) error {
+	_, err := store.DB.Exec(ctx, `
+		DELETE FROM chatwoot_csat_survey
+		 WHERE chatwoot_conversation_id = $1`, conversationID)
+	return err
+}
+
+func (store *Database) ClearCSATSurveyForRoom(ctx context.Context, roomID id.RoomID) error {
+	_, err := store.DB.Exec(ctx, `
+		DELETE FROM chatwoot_csat_survey
+		 WHERE matrix_room_id = $1`, roomID)
+	return err
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// PendingInput is an interactive Chatwoot message that is waiting for the
+// customer to answer it in the Matrix room.
+type PendingInput struct {
+	ChatwootMessageID chatwootapi.MessageID
+	ContentType       chatwootapi.ContentType
+	Options           []chatwootapi.SubmittedValue
+	CreatedAt         time.Time
+}
+
+func (store *Database) SetPendingInputForRoom(ctx context.Context, roomID id.RoomID, input PendingInput) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "set_pending_input_for_room").
+		Int("chatwoot_message_id", int(input.ChatwootMessageID)).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	options, err := json.Marshal(input.Options)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending input options: %w", err)
+	}
+
+	log.Debug().Msg("setting pending input for room")
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		upsert := `
+			INSERT INTO chatwoot_pending_input (matrix_room_id, chatwoot_message_id, content_type, options, created_at)
+				VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (matrix_room_id) DO UPDATE
+				SET chatwoot_message_id = $2, content_type = $3, options = $4, created_at = $5
+		`
+		_, err := store.DB.Exec(ctx, upsert, roomID, input.ChatwootMessageID, input.ContentType, string(options), time.Now().UnixMilli())
+		return err
+	})
+}
+
+func (store *Database) GetPendingInputForRoom(ctx context.Context, roomID id.RoomID) (*PendingInput, error) {
+	row := store.DB.QueryRow(ctx, `
+		SELECT chatwoot_message_id, content_type, options, created_at
+		  FROM chatwoot_pending_input
+		 WHERE matrix_room_id = $1`, roomID)
+	var input PendingInput
+	var options string
+	var createdAt sql.NullInt64
+	if err := row.Scan(&input.ChatwootMessageID, &input.ContentType, &options, &createdAt); err != nil {
+		return nil, err
+	}
+	if createdAt.Valid {
+		input.CreatedAt = time.UnixMilli(createdAt.Int64)
+	}
+	if err := json.Unmarshal([]byte(options), &input.Options); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pending input options: %w", err)
+	}
+	return &input, nil
+}
+
+func (store *Database) ClearPendingInputForRoom(ctx context.Context, roomID id.RoomID) error {
+	_, err := store.DB.Exec(ctx, `
+		DELETE FROM chatwoot_pending_input
+		 WHERE matrix_room_id = $1`, roomID)
+	return err
+}
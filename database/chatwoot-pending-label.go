@@ -0,0 +1,89 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// AddPendingLabels schedules labels to be added to the conversation at the
+// given time. Labels that are already scheduled for the conversation keep
+// their original time.
+func (store *Database) AddPendingLabels(ctx context.Context, conversationID chatwootapi.ConversationID, labels []string, applyAt time.Time) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "add_pending_labels").
+		Int("conversation_id", int(conversationID)).
+		Strs("labels", labels).
+		Time("apply_at", applyAt).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Debug().Msg("adding pending labels")
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, label := range labels {
+			_, err := store.DB.Exec(ctx, `
+				INSERT INTO chatwoot_pending_label (chatwoot_conversation_id, label, apply_at)
+					VALUES ($1, $2, $3)
+				ON CONFLICT (chatwoot_conversation_id, label) DO NOTHING
+			`, conversationID, label, applyAt.UnixMilli())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetDuePendingLabels returns the labels that are due to be added at the given
+// time, grouped by conversation.
+func (store *Database) GetDuePendingLabels(ctx context.Context, now time.Time) (map[chatwootapi.ConversationID][]string, error) {
+	rows, err := store.DB.Query(ctx, `
+		SELECT chatwoot_conversation_id, label
+		  FROM chatwoot_pending_label
+		 WHERE apply_at <= $1`, now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := map[chatwootapi.ConversationID][]string{}
+	for rows.Next() {
+		var conversationID chatwootapi.ConversationID
+		var label string
+		if err := rows.Scan(&conversationID, &label); err != nil {
+			return nil, err
+		}
+		labels[conversationID] = append(labels[conversationID], label)
+	}
+	return labels, rows.Err()
+}
+
+// DeletePendingLabels removes labels that were added to the conversation.
+func (store *Database) DeletePendingLabels(ctx context.Context, conversationID chatwootapi.ConversationID, labels []string) error {
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, label := range labels {
+			_, err := store.DB.Exec(ctx, `
+				DELETE FROM chatwoot_pending_label
+				 WHERE chatwoot_conversation_id = $1 AND label = $2
+			`, conversationID, label)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PostponePendingLabels moves all of the pending labels of the conversation
+// to the given time, for example after adding them failed.
+func (store *Database) PostponePendingLabels(ctx context.Context, conversationID chatwootapi.ConversationID, applyAt time.Time) error {
+	_, err := store.DB.Exec(ctx, `
+		UPDATE chatwoot_pending_label
+		   SET apply_at = $1
+		 WHERE chatwoot_conversation_id = $2
+	`, applyAt.UnixMilli(), conversationID)
+	return err
+}
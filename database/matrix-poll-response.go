@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+// SetPollResponse stores the answers of a user to a poll. Only the most recent
+// response of each user is kept, so older responses that arrive late are
+// ignored.
+func (store *Database) SetPollResponse(ctx context.Context, pollEventID id.EventID, userID id.UserID, answers []string, timestamp time.Time) error {
+	log := zerolog.Ctx(ctx).With().
+		Stringer("poll_event_id", pollEventID).
+		Stringer("user_id", userID).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	answersJSON, err := json.Marshal(answers)
+	if err != nil {
+		return fmt.Errorf("failed to marshal poll answers: %w", err)
+	}
+
+	log.Debug().Msg("setting poll response")
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		upsert := `
+			INSERT INTO matrix_poll_response (poll_event_id, user_id, answers, timestamp)
+				VALUES ($1, $2, $3, $4)
+			ON CONFLICT (poll_event_id, user_id) DO UPDATE
+				SET answers = excluded.answers, timestamp = excluded.timestamp
+				WHERE matrix_poll_response.timestamp < excluded.timestamp
+		`
+		_, err := store.DB.Exec(ctx, upsert, pollEventID, userID, string(answersJSON), timestamp.UnixMilli())
+		return err
+	})
+}
+
+// GetPollResponses returns the answers of every user that responded to the
+// poll before the given time.
+func (store *Database) GetPollResponses(ctx context.Context, pollEventID id.EventID, before time.Time) (map[id.UserID][]string, error) {
+	var rows dbutil.Rows
+	rows, err := store.DB.Query(ctx, `
+		SELECT user_id, answers
+		  FROM matrix_poll_response
+		 WHERE poll_event_id = $1 AND timestamp <= $2`, pollEventID, before.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	responses := map[id.UserID][]string{}
+	for rows.Next() {
+		var userID id.UserID
+		var answersJSON string
+		if err := rows.Scan(&userID, &answersJSON); err != nil {
+			return nil, err
+		}
+		var answers []string
+		if err := json.Unmarshal([]byte(answersJSON), &answers); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal poll answers: %w", err)
+		}
+		responses[userID] = answers
+	}
+	return responses, rows.Err()
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// RoomActivity is the time of the most recent activity in a room that has a
+// Chatwoot conversation.
+type RoomActivity struct {
+	RoomID         id.RoomID
+	ConversationID chatwootapi.ConversationID
+	LastActivity   time.Time
+}
+
+// GetRoomActivity returns the activity of all rooms that have a Chatwoot
+// conversation and that haven't been cleaned up.
+func (store *Database) GetRoomActivity(ctx context.Context) ([]RoomActivity, error) {
+	rows, err := store.DB.Query(ctx, `
+		SELECT c.matrix_room_id, c.chatwoot_conversation_id, COALESCE(c.last_activity_ts, 0)
+		  FROM chatwoot_conversation_to_matrix_room c
+		 WHERE NOT EXISTS (
+			SELECT 1 FROM matrix_room_cleanup r WHERE r.matrix_room_id = c.matrix_room_id
+		 )`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var activity []RoomActivity
+	for rows.Next() {
+		var room RoomActivity
+		var lastActivityTS int64
+		if err := rows.Scan(&room.RoomID, &room.ConversationID, &lastActivityTS); err != nil {
+			return nil, err
+		}
+		if lastActivityTS != 0 {
+			room.LastActivity = time.UnixMilli(lastActivityTS)
+		}
+		activity = append(activity, room)
+	}
+	return activity, rows.Err()
+}
+
+// AddRoomCleanup records that the bot left the room.
+func (store *Database) AddRoomCleanup(ctx context.Context, roomID id.RoomID, conversationID chatwootapi.ConversationID, reason string, forgotten bool) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "add_room_cleanup").
+		Stringer("room_id", roomID).
+		Int("conversation_id", int(conversationID)).
+		Str("reason", reason).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Debug().Msg("recording room cleanup")
+	_, err := store.DB.Exec(ctx, `
+		INSERT INTO matrix_room_cleanup (matrix_room_id, chatwoot_conversation_id, reason, forgotten, cleaned_up_at)
+			VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (matrix_room_id) DO UPDATE
+			SET chatwoot_conversation_id = $2, reason = $3, forgotten = $4, cleaned_up_at = $5
+	`, roomID, conversationID, reason, forgotten, time.Now().UnixMilli())
+	return err
+}
+
+// DeleteRoomCleanup removes the cleanup record of the room when the bot joins
+// it again. The activity of the room is reset, so that it isn't immediately
+// considered inactive again.
+func (store *Database) DeleteRoomCleanup(ctx context.Context, roomID id.RoomID) error {
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		_, err := store.DB.Exec(ctx, "DELETE FROM matrix_room_cleanup WHERE matrix_room_id = $1", roomID)
+		if err != nil {
+			return err
+		}
+		_, err = store.DB.Exec(ctx, `
+			UPDATE chatwoot_conversation_to_matrix_room
+			   SET last_activity_ts = $2
+			 WHERE matrix_room_id = $1
+		`, roomID, time.Now().UnixMilli())
+		return err
+	})
+}
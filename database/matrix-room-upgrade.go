@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// MoveConversationToUpgradedRoom moves the conversation of a room that was
+// upgraded, along with the state that is kept per room, to the replacement
+// room. The message mappings are kept as they are, since they are not tied to
+// a room.
+func (store *Database) MoveConversationToUpgradedRoom(ctx context.Context, oldRoomID, newRoomID id.RoomID, conversationID chatwootapi.ConversationID) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "move_conversation_to_upgraded_room").
+		Stringer("old_room_id", oldRoomID).
+		Stringer("new_room_id", newRoomID).
+		Int("conversation_id", int(conversationID)).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Info().Msg("moving conversation to upgraded room")
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		if err := store.moveRoomState(ctx, oldRoomID, newRoomID); err != nil {
+			return err
+		}
+		_, err := store.DB.Exec(ctx, `
+			INSERT INTO matrix_room_upgrade (old_room_id, new_room_id, chatwoot_conversation_id)
+				VALUES ($1, $2, $3)
+			ON CONFLICT (old_room_id) DO UPDATE
+				SET new_room_id = $2, chatwoot_conversation_id = $3
+		`, oldRoomID, newRoomID, conversationID)
+		return err
+	})
+}
+
+// RevertRoomUpgrade moves the conversation back to the old room, for example
+// because the replacement room couldn't be joined.
+func (store *Database) RevertRoomUpgrade(ctx context.Context, oldRoomID, newRoomID id.RoomID) error {
+	zerolog.Ctx(ctx).Info().
+		Stringer("old_room_id", oldRoomID).
+		Stringer("new_room_id", newRoomID).
+		Msg("reverting room upgrade")
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		if err := store.moveRoomState(ctx, newRoomID, oldRoomID); err != nil {
+			return err
+		}
+		_, err := store.DB.Exec(ctx, "DELETE FROM matrix_room_upgrade WHERE old_room_id = $1", oldRoomID)
+		return err
+	})
+}
+
+// moveRoomState moves the conversation mapping and the state that is kept
+// per room from one room to another.
+func (store *Database) moveRoomState(ctx context.Context, fromRoomID, toRoomID id.RoomID) error {
+	_, err := store.DB.Exec(ctx, `
+		UPDATE chatwoot_conversation_to_matrix_room
+		   SET matrix_room_id = $2, most_recent_event_id = NULL
+		 WHERE matrix_room_id = $1
+	`, fromRoomID, toRoomID)
+	if err != nil {
+		return fmt.Errorf("failed to move conversation: %w", err)
+	}
+	for _, table := range []string{"chatwoot_pending_input", "chatwoot_csat_survey", "chatwoot_contact_profile"} {
+		_, err = store.DB.Exec(ctx, fmt.Sprintf(`
+			UPDATE %s
+			   SET matrix_room_id = $2
+			 WHERE matrix_room_id = $1
+		`, table), fromRoomID, toRoomID)
+		if err != nil {
+			return fmt.Errorf("failed to move %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// GetUpgradedRoomsForConversation returns the rooms that the conversation was
+// in before they were upgraded.
+func (store *Database) GetUpgradedRoomsForConversation(ctx context.Context, conversationID chatwootapi.ConversationID) ([]id.RoomID, error) {
+	rows, err := store.DB.Query(ctx, `
+		SELECT old_room_id
+		  FROM matrix_room_upgrade
+		 WHERE chatwoot_conversation_id = $1`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roomIDs []id.RoomID
+	for rows.Next() {
+		var roomID id.RoomID
+		if err := rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+// GetReplacementRoom returns the room that the given room was upgraded to. If
+// the room wasn't upgraded, sql.ErrNoRows is returned.
+func (store *Database) GetReplacementRoom(ctx context.Context, oldRoomID id.RoomID) (id.RoomID, error) {
+	var newRoomID id.RoomID
+	err := store.DB.QueryRow(ctx, `
+		SELECT new_room_id
+		  FROM matrix_room_upgrade
+		 WHERE old_room_id = $1`, oldRoomID).Scan(&newRoomID)
+	return newRoomID, err
+}
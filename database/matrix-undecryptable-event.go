@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// AddUndecryptableEvent queues an event that could not be decrypted so that
+// decryption can be retried when its Megolm session arrives.
+func (store *Database) AddUndecryptableEvent(ctx context.Context, evt *event.Event, sessionID id.SessionID) error {
+	log := zerolog.Ctx(ctx).With().
+		Stringer("event_id", evt.ID).
+		Stringer("session_id", sessionID).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	eventJSON, err := json.Marshal(evt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal undecryptable event: %w", err)
+	}
+
+	log.Debug().Msg("adding undecryptable event")
+	return store.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		insert := `
+			INSERT INTO matrix_undecryptable_event (event_id, room_id, session_id, event_json, timestamp)
+				VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (event_id) DO NOTHING
+		`
+		_, err := store.DB.Exec(ctx, insert, evt.ID, evt.RoomID, sessionID, string(eventJSON), evt.Timestamp)
+		return err
+	})
+}
+
+// GetUndecryptableEventsForSession returns the queued events that were
+// encrypted with the given Megolm session, oldest first.
+func (store *Database) GetUndecryptableEventsForSession(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) ([]*event.Event, error) {
+	var rows dbutil.Rows
+	rows, err := store.DB.Query(ctx, `
+		SELECT event_json
+		  FROM matrix_undecryptable_event
+		 WHERE room_id = $1 AND session_id = $2
+		 ORDER BY timestamp`, roomID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*event.Event
+	for rows.Next() {
+		var eventJSON string
+		if err := rows.Scan(&eventJSON); err != nil {
+			return nil, err
+		}
+		var evt event.Event
+		if err := json.Unmarshal([]byte(eventJSON), &evt); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal undecryptable event: %w", err)
+		}
+		events = append(events, &evt)
+	}
+	return events, rows.Err()
+}
+
+func (store *Database) DeleteUndecryptableEvent(ctx context.Context, eventID id.EventID) error {
+	_, err := store.DB.Exec(ctx, `
+		DELETE FROM matrix_undecryptable_event
+		 WHERE event_id = $1`, eventID)
+	return err
+}
+
+// DeleteUndecryptableEventsBefore removes the queued events that were sent
+// before the given time, and returns how many were removed.
+func (store *Database) DeleteUndecryptableEventsBefore(ctx context.Context, before time.Time) (int64, error) {
+	res, err := store.DB.Exec(ctx, `
+		DELETE FROM matrix_undecryptable_event
+		 WHERE timestamp < $1`, before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
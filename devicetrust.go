@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/crypto/cryptohelper"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// flaggedDevices contains the (room, device) pairs that agents have already
+// been warned about, so that they are not warned about every message.
+var flaggedDevices sync.Map
+
+// resolveDeviceTrust returns the trust state of the given device.
+func resolveDeviceTrust(ctx context.Context, device *id.Device) id.TrustState {
+	trust, err := client.Crypto.(*cryptohelper.CryptoHelper).Machine().ResolveTrustContext(ctx, device)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("device_id", device.DeviceID).Msg("failed to resolve device trust")
+	}
+	return trust
+}
+
+// VerifyFromTrustedDevice checks that an event was sent from a device that
+// satisfies the device trust policy. Events from untrusted devices are flagged
+// to the agents with a private note. It returns whether the event should be
+// bridged.
+func VerifyFromTrustedDevice(ctx context.Context, evt *event.Event) bool {
+	log := zerolog.Ctx(ctx)
+	minTrust := configuration.DeviceTrust.Policy.MinTrust()
+	if evt.Mautrix.EventSource&event.SourceDecrypted == 0 || evt.Mautrix.TrustState >= minTrust {
+		return true
+	}
+
+	deviceID := id.DeviceID("unknown device")
+	if evt.Mautrix.TrustSource != nil {
+		deviceID = evt.Mautrix.TrustSource.DeviceID
+	}
+	log.Warn().
+		Stringer("device_id", deviceID).
+		Stringer("device_trust", evt.Mautrix.TrustState).
+		Stringer("min_trust", minTrust).
+		Msg("event was sent from an untrusted device")
+
+	reject := configuration.DeviceTrust.RejectUntrustedEvents
+	if !reject {
+		if _, alreadyFlagged := flaggedDevices.LoadOrStore(fmt.Sprintf("%s|%s|%s", evt.RoomID, evt.Sender, deviceID), struct{}{}); alreadyFlagged {
+			return true
+		}
+	}
+
+	// This runs in the sync loop, so the note is sent from the room queue to
+	// avoid blocking the sync while Chatwoot is slow.
+	roomQueue.Enqueue(evt.RoomID, func() {
+		conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, evt.RoomID)
+		if err != nil {
+			log.Warn().Err(err).Msg("no Chatwoot conversation associated with this room")
+			return
+		}
+
+		note := fmt.Sprintf("**Warning: %s sent a message from a device that is not trusted (%s, trust level: %s).** The sender may not be who they claim to be.", evt.Sender, deviceID, evt.Mautrix.TrustState)
+		if reject {
+			note = fmt.Sprintf("**Rejected Matrix event (%s) from %s because it was sent from a device that is not trusted (%s, trust level: %s).**", evt.ID, evt.Sender, deviceID, evt.Mautrix.TrustState)
+		}
+		DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send untrusted device note to %d", conversationID), func(ctx context.Context) (*chatwootapi.Message, error) {
+			return chatwootAPI.SendPrivateMessage(ctx, conversationID, note)
+		})
+	})
+	return !reject
+}
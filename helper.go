@@ -2,60 +2,56 @@ package main
 
 import (
 	"context"
+	"errors"
 	_ "strconv"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
-	"github.com/sethvargo/go-retry"
+
+	"github.com/beeper/chatwoot/chatwootapi"
 )
 
-func DoRetry[T any](ctx context.Context, description string, fn func(context.Context) (*T, error)) (*T, error) {
-	log := zerolog.Ctx(ctx).With().Str("do_retry", description).Logger()
-	var err error
-	b := retry.NewFibonacci(1 * time.Second)
-	b = retry.WithMaxRetries(5, b)
-	attemptNum := 0
-	for {
-		attemptNum++
-		attemptLogger := log.With().Int("attempt", attemptNum).Logger()
-		attemptLogger.Debug().Msg("trying")
-		var val *T
-		val, err = fn(attemptLogger.WithContext(ctx))
-		if err == nil {
-			attemptLogger.Debug().Msg("succeeded")
-			return val, nil
-		}
-		nextDuration, stop := b.Next()
-		attemptLogger.Info().Err(err).
-			Float64("retry_in_sec", nextDuration.Seconds()).
-			Msg("failed")
-		if stop {
-			attemptLogger.Warn().Err(err).
-				Msg("failed. Retry limit reached. Will not retry.")
-			break
-		}
-		time.Sleep(nextDuration)
+// checkRetry classifies the error of a failed attempt. It returns whether the
+// operation should be retried, and how long to wait before the next attempt.
+// Permanent Chatwoot errors (such as 404 or 422) are not retried, and if
+// Chatwoot asked us to back off, we wait at least as long as it asked.
+func checkRetry(log *zerolog.Logger, err error, nextDuration time.Duration) (time.Duration, bool) {
+	var chatwootErr *chatwootapi.Error
+	if !errors.As(err, &chatwootErr) {
+		return nextDuration, true
+	} else if chatwootErr.IsPermanent() {
+		log.Warn().Err(err).Msg("failed with a permanent error. Will not retry.")
+		return 0, false
+	} else if chatwootErr.IsRateLimited() {
+		log.Warn().Dur("retry_after", chatwootErr.RetryAfter).Msg("rate limited by Chatwoot")
 	}
-	return nil, err
+	return max(nextDuration, chatwootErr.RetryAfter), true
 }
 
-func DoRetryArr[T any](ctx context.Context, description string, fn func(context.Context) ([]T, error)) ([]T, error) {
-	log := zerolog.Ctx(ctx).With().Str("do_retry", description).Logger()
+func doRetry[T any](ctx context.Context, class RetryClass, description string, fn func(context.Context) (T, error)) (T, error) {
+	log := zerolog.Ctx(ctx).With().Str("do_retry", description).Str("retry_class", string(class)).Logger()
+	b := configuration.Retry.PolicyFor(class).Backoff()
+	metrics := retryMetricsFor(class)
+	var val T
 	var err error
-	b := retry.NewFibonacci(1 * time.Second)
-	b = retry.WithMaxRetries(5, b)
 	attemptNum := 0
 	for {
 		attemptNum++
+		metrics.Attempts.Add(1)
 		attemptLogger := log.With().Int("attempt", attemptNum).Logger()
 		attemptLogger.Debug().Msg("trying")
-		var val []T
 		val, err = fn(attemptLogger.WithContext(ctx))
 		if err == nil {
 			attemptLogger.Debug().Msg("succeeded")
+			metrics.Successes.Add(1)
 			return val, nil
 		}
 		nextDuration, stop := b.Next()
+		nextDuration, retryable := checkRetry(&attemptLogger, err, nextDuration)
+		if !retryable {
+			break
+		}
 		attemptLogger.Info().Err(err).
 			Float64("retry_in_sec", nextDuration.Seconds()).
 			Msg("failed")
@@ -64,7 +60,46 @@ func DoRetryArr[T any](ctx context.Context, description string, fn func(context.
 				Msg("failed. Retry limit reached. Will not retry.")
 			break
 		}
-		time.Sleep(nextDuration)
+
+		timer := time.NewTimer(nextDuration)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			attemptLogger.Warn().Err(err).
+				AnErr("context_err", ctx.Err()).
+				Msg("failed. Context cancelled. Will not retry.")
+			metrics.Failures.Add(1)
+			var zero T
+			return zero, err
+		case <-timer.C:
+		}
+		metrics.Retries.Add(1)
+	}
+	metrics.Failures.Add(1)
+	var zero T
+	return zero, err
+}
+
+func DoRetry[T any](ctx context.Context, class RetryClass, description string, fn func(context.Context) (*T, error)) (*T, error) {
+	return doRetry(ctx, class, description, fn)
+}
+
+func DoRetryArr[T any](ctx context.Context, class RetryClass, description string, fn func(context.Context) ([]T, error)) ([]T, error) {
+	return doRetry(ctx, class, description, fn)
+}
+
+// waitContext waits until the wait group is done, or until the context is
+// done.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return nil, err
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	inviteHistoryLock sync.Mutex
+	// inviteHistory contains the times of the recently accepted invites of
+	// each inviter.
+	inviteHistory = map[id.UserID][]time.Time{}
+)
+
+// allowInvite returns whether an invite from the inviter is within the rate
+// limit, and records it if it is.
+func allowInvite(inviter id.UserID) bool {
+	limit := configuration.InvitePolicy.RateLimit
+	if limit.MaxInvites <= 0 {
+		return true
+	}
+
+	inviteHistoryLock.Lock()
+	defer inviteHistoryLock.Unlock()
+
+	// Forget the invites that are outside of the period, and the inviters
+	// without recent invites, so that the history doesn't grow forever.
+	now := time.Now()
+	for user, times := range inviteHistory {
+		recent := slices.DeleteFunc(times, func(ts time.Time) bool {
+			return now.Sub(ts) >= limit.Period
+		})
+		if len(recent) == 0 {
+			delete(inviteHistory, user)
+		} else {
+			inviteHistory[user] = recent
+		}
+	}
+	if len(inviteHistory[inviter]) >= limit.MaxInvites {
+		return false
+	}
+	inviteHistory[inviter] = append(inviteHistory[inviter], now)
+	return true
+}
+
+// HandleInvite accepts or rejects an invite of the bot according to the
+// invite policy.
+func HandleInvite(ctx context.Context, evt *event.Event) {
+	log := zerolog.Ctx(ctx).With().Str("component", "handle_invite").Logger()
+	ctx = log.WithContext(ctx)
+
+	reject := func(reason string) {
+		log.Info().Str("reason", reason).Msg("rejecting invite")
+		_, err := client.LeaveRoom(ctx, evt.RoomID, &mautrix.ReqLeave{Reason: reason})
+		if err != nil {
+			log.Err(err).Msg("failed to reject invite")
+		}
+	}
+
+	if !VerifyFromAuthorizedUser(ctx, evt.Sender) {
+		reject("Invites from this homeserver are not allowed")
+		return
+	} else if !allowInvite(evt.Sender) {
+		reject("Too many invites, please try again later")
+		return
+	}
+
+	log.Info().Msg("accepting invite")
+	_, err := DoRetry(ctx, RetryMatrixSend, fmt.Sprintf("join room %s", evt.RoomID), func(ctx context.Context) (*mautrix.RespJoinRoom, error) {
+		return client.JoinRoom(ctx, evt.RoomID.String(), &mautrix.ReqJoinRoom{Via: []string{evt.Sender.Homeserver()}})
+	})
+	if err != nil {
+		log.Err(err).Msg("failed to accept invite")
+		return
+	}
+	if err = stateStore.DeleteRoomCleanup(ctx, evt.RoomID); err != nil {
+		log.Warn().Err(err).Msg("failed to delete room cleanup record")
+	}
+
+	if configuration.InvitePolicy.CreateConversation {
+		conversationID, _, err := createChatwootConversation(ctx, evt.RoomID, evt.Sender, evt, map[string]string{})
+		if err != nil {
+			log.Err(err).Msg("failed to create Chatwoot conversation for invite")
+		} else {
+			log.Info().Int("conversation_id", int(conversationID)).Msg("created Chatwoot conversation for invite")
+		}
+	}
+
+	if configuration.InvitePolicy.Greeting != "" {
+		SendMessage(ctx, evt.RoomID, &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    configuration.InvitePolicy.Greeting,
+		})
+	}
+}
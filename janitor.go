@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/sqlstatestore"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+	"github.com/beeper/chatwoot/database"
+)
+
+// RoomCleanupReason is why the bot left a room.
+type RoomCleanupReason string
+
+const (
+	RoomCleanupReasonNone         RoomCleanupReason = ""
+	RoomCleanupReasonCustomerLeft RoomCleanupReason = "customer_left"
+	RoomCleanupReasonInactive     RoomCleanupReason = "inactive"
+)
+
+// scheduledRoomCleanups are the rooms whose cleanup is queued or running, so
+// that a room isn't scheduled again if its queue is backed up past the
+// janitor interval.
+var scheduledRoomCleanups sync.Map
+
+// RunRoomJanitor periodically cleans up the rooms that were abandoned by the
+// customer or that have been inactive for too long.
+func RunRoomJanitor(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("component", "room_janitor").Logger()
+	ctx = log.WithContext(ctx)
+
+	ticker := time.NewTicker(configuration.RoomCleanup.Interval)
+	defer ticker.Stop()
+	for {
+		rooms, err := stateStore.GetRoomActivity(ctx)
+		if err != nil {
+			log.Err(err).Msg("failed to get room activity")
+		}
+		for _, room := range rooms {
+			reason := getRoomCleanupReason(ctx, room)
+			if reason == RoomCleanupReasonNone {
+				continue
+			} else if _, scheduled := scheduledRoomCleanups.LoadOrStore(room.RoomID, struct{}{}); scheduled {
+				continue
+			}
+			// Clean up the room in its queue, so that it doesn't race with
+			// events that are being bridged. Queued jobs are drained on
+			// shutdown, so they shouldn't be cancelled when the janitor stops.
+			roomCtx := log.With().
+				Stringer("room_id", room.RoomID).
+				Int("conversation_id", int(room.ConversationID)).
+				Logger().
+				WithContext(context.WithoutCancel(ctx))
+			roomQueue.Enqueue(room.RoomID, func() {
+				defer scheduledRoomCleanups.Delete(room.RoomID)
+				cleanUpRoom(roomCtx, room, reason)
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// getRoomCleanupReason returns why the room should be cleaned up, or
+// RoomCleanupReasonNone if it shouldn't be.
+func getRoomCleanupReason(ctx context.Context, room database.RoomActivity) RoomCleanupReason {
+	if configuration.RoomCleanup.LeaveIfCustomerLeft {
+		joinedMembers, err := client.StateStore.(*sqlstatestore.SQLStateStore).GetRoomMembers(ctx, room.RoomID, event.MembershipJoin)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Stringer("room_id", room.RoomID).Msg("failed to get joined members")
+		} else {
+			delete(joinedMembers, configuration.Username)
+			if len(joinedMembers) == 0 && customerLeft(ctx, room.RoomID) {
+				return RoomCleanupReasonCustomerLeft
+			}
+		}
+	}
+	if configuration.RoomCleanup.InactiveAfter > 0 && !room.LastActivity.IsZero() &&
+		time.Since(room.LastActivity) > configuration.RoomCleanup.InactiveAfter {
+		return RoomCleanupReasonInactive
+	}
+	return RoomCleanupReasonNone
+}
+
+// customerLeft confirms with the homeserver that nobody but the bot is joined
+// to the room. The local state store can be out of date, and cleaning up a
+// room can't be undone.
+func customerLeft(ctx context.Context, roomID id.RoomID) bool {
+	resp, err := client.JoinedMembers(ctx, roomID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("room_id", roomID).Msg("failed to get joined members from the server")
+		return false
+	}
+	delete(resp.Joined, configuration.Username)
+	return len(resp.Joined) == 0
+}
+
+// cleanUpRoom leaves the room, resolves its conversation, and records that
+// the room was cleaned up.
+func cleanUpRoom(ctx context.Context, room database.RoomActivity, reason RoomCleanupReason) {
+	log := zerolog.Ctx(ctx).With().Str("reason", string(reason)).Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().Msg("cleaning up room")
+
+	// The bot may already have been removed from the room.
+	membership, err := client.StateStore.(*sqlstatestore.SQLStateStore).GetMembership(ctx, room.RoomID, configuration.Username)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to get bot membership")
+	}
+	if membership == event.MembershipJoin {
+		_, err = DoRetry(ctx, RetryMatrixSend, fmt.Sprintf("leave room %s", room.RoomID), func(ctx context.Context) (*mautrix.RespLeaveRoom, error) {
+			return client.LeaveRoom(ctx, room.RoomID, &mautrix.ReqLeave{Reason: string(reason)})
+		})
+		if err != nil {
+			log.Err(err).Msg("failed to leave room")
+			return
+		}
+	}
+
+	var note string
+	switch reason {
+	case RoomCleanupReasonCustomerLeft:
+		note = "**The bot left the Matrix room because the customer left it.**"
+	case RoomCleanupReasonInactive:
+		note = fmt.Sprintf("**The bot left the Matrix room because it was inactive for more than %s.**", configuration.RoomCleanup.InactiveAfter)
+	}
+	DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send room cleanup note to %d", room.ConversationID), func(ctx context.Context) (*chatwootapi.Message, error) {
+		return chatwootAPI.SendPrivateMessage(ctx, room.ConversationID, note)
+	})
+	if err := chatwootAPI.ToggleStatus(ctx, room.ConversationID, chatwootapi.ConversationStatusResolved); err != nil {
+		log.Err(err).Msg("failed to resolve conversation")
+	}
+
+	forgotten := false
+	if configuration.RoomCleanup.Forget {
+		if _, err = client.ForgetRoom(ctx, room.RoomID); err != nil {
+			log.Warn().Err(err).Msg("failed to forget room")
+		} else {
+			forgotten = true
+		}
+	}
+
+	if err = stateStore.AddRoomCleanup(ctx, room.RoomID, room.ConversationID, string(reason), forgotten); err != nil {
+		log.Err(err).Msg("failed to record room cleanup")
+	}
+}
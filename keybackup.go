@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/crypto/signatures"
+	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// keyBackupUploadInterval is how often new Megolm sessions are uploaded to
+// the server-side key backup.
+const keyBackupUploadInterval = 5 * time.Minute
+
+// keyBackupUploadBatchSize is the maximum number of sessions uploaded in a
+// single request.
+const keyBackupUploadBatchSize = 100
+
+// KeyBackup is the server-side (online) key backup that the bot uploads its
+// Megolm sessions to, and fetches missing sessions from when it can't decrypt
+// an event.
+type KeyBackup struct {
+	mach    *crypto.OlmMachine
+	key     *backup.MegolmBackupKey
+	version id.KeyBackupVersion
+
+	uploadLock sync.Mutex
+}
+
+// keyBackup is nil if the key backup is disabled or could not be set up.
+var keyBackup *KeyBackup
+
+// SetupKeyBackup unlocks SSSS with the recovery key, loads the Megolm backup
+// key from it and verifies that the latest key backup version on the server
+// matches. If there is no backup yet and create_if_missing is enabled, a new
+// backup is created and its key is stored in SSSS.
+func SetupKeyBackup(ctx context.Context, mach *crypto.OlmMachine, recoveryKey string) (*KeyBackup, error) {
+	log := zerolog.Ctx(ctx).With().Str("component", "setup_key_backup").Logger()
+	ctx = log.WithContext(ctx)
+
+	keyID, keyData, err := mach.SSSS.GetDefaultKeyData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default SSSS key data: %w", err)
+	}
+	ssssKey, err := keyData.VerifyRecoveryKey(keyID, recoveryKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock SSSS with recovery key: %w", err)
+	}
+
+	keyBytes, err := mach.SSSS.GetDecryptedAccountData(ctx, event.AccountDataMegolmBackupKey, ssssKey)
+	if errors.Is(err, mautrix.MNotFound) || errors.Is(err, ssss.ErrNotEncryptedForKey) {
+		if !configuration.KeyBackup.CreateIfMissing {
+			return nil, fmt.Errorf("no Megolm backup key found in SSSS and create_if_missing is disabled: %w", err)
+		}
+		log.Info().Msg("no Megolm backup key found in SSSS, creating a new key backup")
+		return createKeyBackup(ctx, mach, ssssKey)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get Megolm backup key from SSSS: %w", err)
+	}
+
+	key, err := backup.MegolmBackupKeyFromBytes(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Megolm backup key in SSSS: %w", err)
+	}
+	versionInfo, err := mach.GetAndVerifyLatestKeyBackupVersion(ctx, key)
+	if errors.Is(err, mautrix.MNotFound) && configuration.KeyBackup.CreateIfMissing {
+		log.Info().Msg("no key backup found on the server, creating a new key backup")
+		return createKeyBackup(ctx, mach, ssssKey)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get latest key backup version: %w", err)
+	} else if versionInfo == nil {
+		return nil, fmt.Errorf("no trusted key backup found on the server")
+	}
+
+	log.Info().Stringer("key_backup_version", versionInfo.Version).Msg("using existing key backup")
+	return &KeyBackup{mach: mach, key: key, version: versionInfo.Version}, nil
+}
+
+func createKeyBackup(ctx context.Context, mach *crypto.OlmMachine, ssssKey *ssss.Key) (*KeyBackup, error) {
+	key, err := backup.NewMegolmBackupKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate Megolm backup key: %w", err)
+	}
+
+	authData := backup.MegolmAuthData{
+		PublicKey: id.Ed25519(base64.RawStdEncoding.EncodeToString(key.PublicKey().Bytes())),
+	}
+	deviceSignature, err := mach.GetAccount().SignJSON(authData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign key backup auth data: %w", err)
+	}
+	authData.Signatures = signatures.NewSingleSignature(mach.Client.UserID, id.KeyAlgorithmEd25519, mach.Client.DeviceID.String(), deviceSignature)
+
+	resp, err := mach.Client.CreateKeyBackupVersion(ctx, &mautrix.ReqRoomKeysVersionCreate[backup.MegolmAuthData]{
+		Algorithm: id.KeyBackupAlgorithmMegolmBackupV1,
+		AuthData:  authData,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key backup version: %w", err)
+	}
+
+	err = mach.SSSS.SetEncryptedAccountData(ctx, event.AccountDataMegolmBackupKey, key.Bytes(), ssssKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store Megolm backup key in SSSS: %w", err)
+	}
+
+	zerolog.Ctx(ctx).Info().Stringer("key_backup_version", resp.Version).Msg("created new key backup")
+	return &KeyBackup{mach: mach, key: key, version: resp.Version}, nil
+}
+
+// UploadRoomKeys uploads all of the Megolm sessions that are not yet in the
+// current key backup version.
+func (kb *KeyBackup) UploadRoomKeys(ctx context.Context) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "upload_room_keys").
+		Stringer("key_backup_version", kb.version).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	kb.uploadLock.Lock()
+	defer kb.uploadLock.Unlock()
+
+	sessions, err := kb.mach.CryptoStore.GetGroupSessionsWithoutKeyBackupVersion(ctx, kb.version).AsList()
+	if err != nil {
+		return fmt.Errorf("failed to get sessions that need to be backed up: %w", err)
+	} else if len(sessions) == 0 {
+		return nil
+	}
+
+	log.Info().Int("session_count", len(sessions)).Msg("uploading room keys to key backup")
+	for start := 0; start < len(sessions); start += keyBackupUploadBatchSize {
+		batch := sessions[start:min(start+keyBackupUploadBatchSize, len(sessions))]
+
+		req := mautrix.ReqKeyBackup{Rooms: map[id.RoomID]mautrix.ReqRoomKeyBackup{}}
+		for _, session := range batch {
+			sessionData, err := kb.encryptSession(session)
+			if err != nil {
+				log.Warn().Err(err).Stringer("session_id", session.ID()).Msg("failed to encrypt session for key backup")
+				continue
+			}
+			room, ok := req.Rooms[session.RoomID]
+			if !ok {
+				room = mautrix.ReqRoomKeyBackup{Sessions: map[id.SessionID]mautrix.ReqKeyBackupData{}}
+				req.Rooms[session.RoomID] = room
+			}
+			room.Sessions[session.ID()] = mautrix.ReqKeyBackupData{
+				FirstMessageIndex: int(session.Internal.FirstKnownIndex()),
+				ForwardedCount:    len(session.ForwardingChains),
+				IsVerified:        false,
+				SessionData:       sessionData,
+			}
+		}
+
+		if _, err = kb.mach.Client.PutKeysInBackup(ctx, kb.version, &req); err != nil {
+			return fmt.Errorf("failed to upload room keys to key backup: %w", err)
+		}
+
+		for _, session := range batch {
+			session.KeyBackupVersion = kb.version
+			if err = kb.mach.CryptoStore.PutGroupSession(ctx, session); err != nil {
+				log.Warn().Err(err).Stringer("session_id", session.ID()).Msg("failed to mark session as backed up")
+			}
+		}
+	}
+	return nil
+}
+
+func (kb *KeyBackup) encryptSession(session *crypto.InboundGroupSession) (json.RawMessage, error) {
+	sessionKey, err := session.Internal.Export(session.Internal.FirstKnownIndex())
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := backup.EncryptSessionData(kb.key, backup.MegolmSessionData{
+		Algorithm:          id.AlgorithmMegolmV1,
+		ForwardingKeyChain: session.ForwardingChains,
+		SenderClaimedKeys:  backup.SenderClaimedKeys{Ed25519: session.SigningKey},
+		SenderKey:          session.SenderKey,
+		SessionKey:         string(sessionKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encrypted)
+}
+
+// RunUploadLoop periodically uploads new Megolm sessions to the key backup
+// until the context is cancelled.
+func (kb *KeyBackup) RunUploadLoop(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+	ticker := time.NewTicker(keyBackupUploadInterval)
+	defer ticker.Stop()
+	for {
+		if err := kb.UploadRoomKeys(ctx); err != nil {
+			log.Err(err).Msg("failed to upload room keys to key backup")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RestoreSession fetches the given Megolm session from the key backup and
+// imports it into the crypto store.
+func (kb *KeyBackup) RestoreSession(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) error {
+	resp, err := kb.mach.Client.GetKeyBackupForRoomAndSession(ctx, kb.version, roomID, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get session %s from key backup: %w", sessionID, err)
+	}
+	sessionData, err := resp.SessionData.Decrypt(kb.key)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt session %s from key backup: %w", sessionID, err)
+	}
+	_, err = kb.mach.ImportRoomKeyFromBackup(ctx, kb.version, roomID, sessionID, sessionData)
+	if err != nil {
+		return fmt.Errorf("failed to import session %s from key backup: %w", sessionID, err)
+	}
+	return nil
+}
+
+// DecryptWithBackup restores the session for an undecryptable event from the
+// key backup and retries decrypting it.
+func (kb *KeyBackup) DecryptWithBackup(ctx context.Context, evt *event.Event) (*event.Event, error) {
+	content, ok := evt.Content.Parsed.(*event.EncryptedEventContent)
+	if !ok {
+		return nil, fmt.Errorf("event is not encrypted")
+	}
+	if err := kb.RestoreSession(ctx, evt.RoomID, content.SessionID); err != nil {
+		return nil, err
+	}
+	return kb.mach.DecryptMegolmEvent(ctx, evt)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// addConversationLabels adds the labels to the conversation, keeping the
+// labels that it already has.
+func addConversationLabels(ctx context.Context, conversationID chatwootapi.ConversationID, labels []string) error {
+	current, err := chatwootAPI.GetConversationLabels(ctx, conversationID)
+	if err != nil {
+		return err
+	}
+	newLabels := slices.Clone(current)
+	for _, label := range labels {
+		if !slices.Contains(newLabels, label) {
+			newLabels = append(newLabels, label)
+		}
+	}
+	if len(newLabels) == len(current) {
+		return nil
+	}
+	return chatwootAPI.SetConversationLabels(ctx, conversationID, newLabels)
+}
+
+// labelSchedulerInterval is how often the label scheduler checks for labels
+// that are due to be added.
+const labelSchedulerInterval = 5 * time.Second
+
+// labelRetryDelay is how long to wait before trying again to add labels after
+// it failed.
+const labelRetryDelay = time.Minute
+
+// labelRule is a LabelRule with its regular expressions compiled.
+type labelRule struct {
+	LabelRule
+	roomName *regexp.Regexp
+}
+
+// labelRules are the rules that add labels to conversations.
+var labelRules []*labelRule
+
+// NewLabelRules validates the label rules from the configuration. If the
+// canonical DM prefix is set, a rule that adds the canonical-dm label to rooms
+// whose name starts with the prefix is added.
+func NewLabelRules(rules []LabelRule, canonicalDMPrefix string) ([]*labelRule, error) {
+	if canonicalDMPrefix != "" {
+		rules = append(slices.Clone(rules), LabelRule{
+			Label:    "canonical-dm",
+			RoomName: "^" + regexp.QuoteMeta(canonicalDMPrefix),
+		})
+	}
+
+	var compiled []*labelRule
+	for i, rule := range rules {
+		if rule.Label == "" {
+			return nil, fmt.Errorf("label rule %d must have a label", i)
+		} else if rule.MinMembers > 0 && rule.MaxMembers > 0 && rule.MinMembers > rule.MaxMembers {
+			return nil, fmt.Errorf("min_members is greater than max_members in label rule %d", i)
+		}
+		r := &labelRule{LabelRule: rule}
+		if rule.RoomName != "" {
+			var err error
+			r.roomName, err = regexp.Compile(rule.RoomName)
+			if err != nil {
+				return nil, fmt.Errorf("invalid room_name regex in label rule %d: %w", i, err)
+			}
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+func (r *labelRule) hasRoomConditions() bool {
+	return r.roomName != nil || r.Network != "" || r.MinMembers > 0 || r.MaxMembers > 0
+}
+
+func (r *labelRule) hasMessageConditions() bool {
+	return len(r.Keywords) > 0 || r.ClientType != ""
+}
+
+func (r *labelRule) matchesRoom(info *conversationInfo) bool {
+	if r.roomName != nil && !r.roomName.MatchString(info.RoomName) {
+		return false
+	} else if r.Network != "" && !containsFold(info.Networks, r.Network) {
+		return false
+	} else if r.MinMembers > 0 && info.MemberCount < r.MinMembers {
+		return false
+	} else if r.MaxMembers > 0 && info.MemberCount > r.MaxMembers {
+		return false
+	}
+	return true
+}
+
+// matchesMessage returns whether the message contains any of the keywords
+// (case-insensitively) and was sent from the client type of the rule.
+func (r *labelRule) matchesMessage(evt *event.Event) bool {
+	if evt == nil || evt.Type != event.EventMessage {
+		return false
+	}
+	if len(r.Keywords) > 0 {
+		body := strings.ToLower(evt.Content.AsMessage().Body)
+		if !slices.ContainsFunc(r.Keywords, func(keyword string) bool {
+			return strings.Contains(body, strings.ToLower(keyword))
+		}) {
+			return false
+		}
+	}
+	if r.ClientType != "" {
+		clientType, _ := evt.Content.Raw["com.beeper.origin_client_type"].(string)
+		if !strings.EqualFold(clientType, r.ClientType) {
+			return false
+		}
+	}
+	return true
+}
+
+// conversationLabels returns the labels of the rules that match a new
+// conversation. The event is the message that caused the conversation to be
+// created.
+func conversationLabels(rules []*labelRule, info *conversationInfo, evt *event.Event) []string {
+	var labels []string
+	for _, rule := range rules {
+		if rule.matchesRoom(info) && (!rule.hasMessageConditions() || rule.matchesMessage(evt)) {
+			labels = append(labels, rule.Label)
+		}
+	}
+	return labels
+}
+
+// messageLabels returns the labels of the rules with message conditions that
+// match a message from the customer. The conversation info is only fetched
+// (once) if a rule that matches the message also has room conditions.
+func messageLabels(rules []*labelRule, evt *event.Event, getInfo func() *conversationInfo) []string {
+	var info *conversationInfo
+	var labels []string
+	for _, rule := range rules {
+		if !rule.hasMessageConditions() || !rule.matchesMessage(evt) {
+			continue
+		}
+		if rule.hasRoomConditions() {
+			if info == nil {
+				info = getInfo()
+			}
+			if !rule.matchesRoom(info) {
+				continue
+			}
+		}
+		labels = append(labels, rule.Label)
+	}
+	return labels
+}
+
+// scheduleConversationLabels schedules the labels of the rules that match a
+// new conversation. The event is the message that caused the conversation to
+// be created. The labels are added after the configured delay, so that they
+// don't race with the Chatwoot automations for new conversations.
+func scheduleConversationLabels(ctx context.Context, conversationID chatwootapi.ConversationID, info *conversationInfo, evt *event.Event) {
+	labels := conversationLabels(labelRules, info, evt)
+	if len(labels) == 0 {
+		return
+	}
+	if err := stateStore.AddPendingLabels(ctx, conversationID, labels, time.Now().Add(configuration.LabelDelay)); err != nil {
+		zerolog.Ctx(ctx).Err(err).Strs("labels", labels).Msg("failed to schedule labels for new conversation")
+	}
+}
+
+// scheduleMessageLabels schedules the labels of the rules with message
+// conditions that match a message from the customer.
+func scheduleMessageLabels(ctx context.Context, conversationID chatwootapi.ConversationID, evt *event.Event) {
+	labels := messageLabels(labelRules, evt, func() *conversationInfo {
+		state, err := client.State(ctx, evt.RoomID)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to get room state for label rules")
+		}
+		return getConversationInfo(evt.Sender, state, evt)
+	})
+	if len(labels) == 0 {
+		return
+	}
+	if err := stateStore.AddPendingLabels(ctx, conversationID, labels, time.Now()); err != nil {
+		zerolog.Ctx(ctx).Err(err).Strs("labels", labels).Msg("failed to schedule labels for message")
+	}
+}
+
+// RunLabelScheduler adds the scheduled labels to conversations when they are
+// due. The schedule is stored in the database, so labels that were scheduled
+// before a restart are still added.
+func RunLabelScheduler(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("component", "label_scheduler").Logger()
+	ctx = log.WithContext(ctx)
+
+	ticker := time.NewTicker(labelSchedulerInterval)
+	defer ticker.Stop()
+	for {
+		pending, err := stateStore.GetDuePendingLabels(ctx, time.Now())
+		if err != nil {
+			log.Err(err).Msg("failed to get pending labels")
+		}
+		for conversationID, labels := range pending {
+			log := log.With().Int("conversation_id", int(conversationID)).Strs("labels", labels).Logger()
+			if err := addConversationLabels(ctx, conversationID, labels); chatwootapi.IsPermanent(err) {
+				// For example, the conversation was deleted.
+				log.Err(err).Msg("failed to add labels to conversation, dropping them")
+				if err = stateStore.DeletePendingLabels(ctx, conversationID, labels); err != nil {
+					log.Err(err).Msg("failed to delete pending labels")
+				}
+				continue
+			} else if err != nil {
+				log.Err(err).Msg("failed to add labels to conversation, will try again later")
+				if err = stateStore.PostponePendingLabels(ctx, conversationID, time.Now().Add(labelRetryDelay)); err != nil {
+					log.Err(err).Msg("failed to postpone pending labels")
+				}
+				continue
+			}
+			log.Info().Msg("added labels to conversation")
+			if err = stateStore.DeletePendingLabels(ctx, conversationID, labels); err != nil {
+				log.Err(err).Msg("failed to delete pending labels")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// testLabelRules are label rules like the ones in the example configuration,
+// with a canonical DM prefix that contains a regex metacharacter.
+func testLabelRules(t *testing.T) []*labelRule {
+	t.Helper()
+	rules, err := NewLabelRules([]LabelRule{
+		{Label: "vip", RoomName: "^VIP"},
+		{Label: "whatsapp", Network: "WhatsApp"},
+		{Label: "group", MinMembers: 3},
+		{Label: "refund", Keywords: []string{"refund", "money back"}},
+		{Label: "ios-bug", ClientType: "ios", Keywords: []string{"crash", "bug"}},
+		{Label: "whatsapp-refund", Network: "whatsapp", Keywords: []string{"refund"}},
+	}, "DM (")
+	if err != nil {
+		t.Fatalf("NewLabelRules: %v", err)
+	}
+	return rules
+}
+
+func TestConversationLabels(t *testing.T) {
+	rules := testLabelRules(t)
+	customer := id.UserID("@whatsapp_123:beeper.local")
+	bot := id.UserID("@help:example.com")
+
+	tests := []struct {
+		name     string
+		info     *conversationInfo
+		message  *event.Event
+		expected []string
+	}{
+		{
+			name:     "WhatsApp DM asking for a refund",
+			info:     getConversationInfo(customer, testRoom("DM (Alice)", "whatsapp", "WhatsApp", customer, bot), nil),
+			message:  testMessage(customer, "Can I get a REFUND?", "", ""),
+			expected: []string{"whatsapp", "refund", "whatsapp-refund", "canonical-dm"},
+		},
+		{
+			name:     "VIP group greeting",
+			info:     getConversationInfo(customer, testRoom("VIP: ACME", "", "", customer, bot, "@bob:example.com"), nil),
+			message:  testMessage(customer, "Hello!", "", ""),
+			expected: []string{"vip", "group"},
+		},
+		{
+			// The DM prefix is matched literally, not as a regex.
+			name:     "iOS crash in a room named like a DM",
+			info:     getConversationInfo(customer, testRoom("DM Alice", "", "", customer, bot), nil),
+			message:  testMessage(customer, "The app crashes on launch", "iOS", ""),
+			expected: []string{"ios-bug"},
+		},
+		{
+			name:    "conversation created by a state event",
+			info:    getConversationInfo(customer, testRoom("Alice", "", "", customer, bot), nil),
+			message: &event.Event{Type: event.StateRoomName},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if labels := conversationLabels(rules, tt.info, tt.message); !slices.Equal(labels, tt.expected) {
+				t.Errorf("labels = %q, expected %q", labels, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMessageLabels(t *testing.T) {
+	rules := testLabelRules(t)
+	customer := id.UserID("@whatsapp_123:beeper.local")
+	room := testRoom("VIP: Alice", "whatsapp", "WhatsApp", customer, "@help:example.com")
+
+	var fetched int
+	getInfo := func() *conversationInfo {
+		fetched++
+		return getConversationInfo(customer, room, nil)
+	}
+
+	// Later messages only add the labels of rules with message conditions,
+	// so the room rules don't add the vip and whatsapp labels again.
+	labels := messageLabels(rules, testMessage(customer, "I want my money back, it's a refund", "", ""), getInfo)
+	if expected := []string{"refund", "whatsapp-refund"}; !slices.Equal(labels, expected) {
+		t.Errorf("labels = %q, expected %q", labels, expected)
+	}
+	if fetched != 1 {
+		t.Errorf("fetched the conversation info %d times, expected once", fetched)
+	}
+
+	// The room isn't needed if no rule with room conditions matches the
+	// message.
+	fetched = 0
+	labels = messageLabels(rules, testMessage(customer, "Found a bug", "ios", ""), getInfo)
+	if expected := []string{"ios-bug"}; !slices.Equal(labels, expected) {
+		t.Errorf("labels = %q, expected %q", labels, expected)
+	}
+	labels = messageLabels(rules, testMessage(customer, "Found a bug", "android", ""), getInfo)
+	if len(labels) != 0 {
+		t.Errorf("labels = %q for a bug report from Android, expected none", labels)
+	}
+	if fetched != 0 {
+		t.Errorf("fetched the conversation info %d times, expected never", fetched)
+	}
+}
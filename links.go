@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// linkRule is a LinkRule with its pattern compiled.
+type linkRule struct {
+	LinkRule
+	pattern *regexp.Regexp
+}
+
+// linkRules are the rules that detect references (for example, issue or order
+// numbers) in messages.
+var linkRules []*linkRule
+
+// NewLinkRules validates the link detection rules from the configuration.
+func NewLinkRules(rules []LinkRule) ([]*linkRule, error) {
+	var compiled []*linkRule
+	for i, rule := range rules {
+		if rule.Pattern == "" || (rule.URL == "" && len(rule.Labels) == 0) {
+			return nil, fmt.Errorf("link rule %d must have a pattern and a url or labels", i)
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern in link rule %d: %w", i, err)
+		}
+		compiled = append(compiled, &linkRule{LinkRule: rule, pattern: pattern})
+	}
+	return compiled, nil
+}
+
+// detectLinks returns the links to the references in the text of a message,
+// and the labels of the rules that matched. Rules are only applied to agent
+// messages if they are configured to be.
+func detectLinks(rules []*linkRule, text string, fromAgent bool) (links, labels []string) {
+	for _, rule := range rules {
+		if fromAgent && !rule.AgentMessages {
+			continue
+		}
+		matches := rule.pattern.FindAllStringSubmatchIndex(text, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		for _, match := range matches {
+			if rule.URL == "" {
+				continue
+			}
+			link := string(rule.pattern.ExpandString(nil, rule.URL, text, match))
+			if !slices.Contains(links, link) {
+				links = append(links, link)
+			}
+		}
+		labels = append(labels, rule.Labels...)
+	}
+	return links, labels
+}
+
+// applyLinkRules detects references in the text of a message and sends the
+// links to them as a private note, and adds the labels of the rules that
+// matched to the conversation.
+func applyLinkRules(ctx context.Context, conversationID chatwootapi.ConversationID, text string, fromAgent bool) {
+	log := zerolog.Ctx(ctx).With().Str("component", "apply_link_rules").Logger()
+	ctx = log.WithContext(ctx)
+
+	links, labels := detectLinks(linkRules, text, fromAgent)
+	if len(links) > 0 {
+		DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send detected links to %d", conversationID), func(ctx context.Context) (*chatwootapi.Message, error) {
+			return chatwootAPI.SendPrivateMessage(ctx, conversationID, strings.Join(links, "\n\n"))
+		})
+	}
+	if len(labels) > 0 {
+		if err := addConversationLabels(ctx, conversationID, labels); err != nil {
+			log.Err(err).Strs("labels", labels).Msg("failed to add labels for detected links")
+		}
+	}
+}
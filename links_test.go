@@ -0,0 +1,65 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDetectLinksExpandsURL(t *testing.T) {
+	const text = "Where is order #42? It was sent with order #7, like order #42."
+	for template, expected := range map[string][]string{
+		"https://shop.example.com/search?q=${0}":      {"https://shop.example.com/search?q=order #42", "https://shop.example.com/search?q=order #7"},
+		"https://shop.example.com/orders/$1":          {"https://shop.example.com/orders/42", "https://shop.example.com/orders/7"},
+		"https://shop.example.com/orders/${order}":    {"https://shop.example.com/orders/42", "https://shop.example.com/orders/7"},
+		"https://shop.example.com/orders/$1/shipping": {"https://shop.example.com/orders/42/shipping", "https://shop.example.com/orders/7/shipping"},
+		// $1_ is the submatch named "1_", which doesn't exist.
+		"https://shop.example.com/orders/$1_details":   {"https://shop.example.com/orders/"},
+		"https://shop.example.com/orders/${1}_details": {"https://shop.example.com/orders/42_details", "https://shop.example.com/orders/7_details"},
+	} {
+		rules, err := NewLinkRules([]LinkRule{{Pattern: `order #(?P<order>\d+)`, URL: template}})
+		if err != nil {
+			t.Fatalf("NewLinkRules: %v", err)
+		}
+		if links, _ := detectLinks(rules, text, false); !slices.Equal(links, expected) {
+			t.Errorf("%s expanded to %q, expected %q", template, links, expected)
+		}
+	}
+}
+
+func TestDetectLinksFromAgents(t *testing.T) {
+	rules, err := NewLinkRules([]LinkRule{
+		{Pattern: `[A-Z]{1,5}-\d+`, URL: "https://linear.app/beeper/issue/${0}", AgentMessages: true},
+		{Pattern: `order #(\d+)`, URL: "https://shop.example.com/orders/$1", Labels: []string{"order"}},
+		{Pattern: `(?i)\brefund`, Labels: []string{"refund", "billing"}},
+	})
+	if err != nil {
+		t.Fatalf("NewLinkRules: %v", err)
+	}
+	const text = "The refund for order #7 is tracked in BE-9 and PLAT-22."
+
+	links, labels := detectLinks(rules, text, false)
+	if expected := []string{
+		"https://linear.app/beeper/issue/BE-9",
+		"https://linear.app/beeper/issue/PLAT-22",
+		"https://shop.example.com/orders/7",
+	}; !slices.Equal(links, expected) {
+		t.Errorf("customer message links = %q, expected %q", links, expected)
+	}
+	if expected := []string{"order", "refund", "billing"}; !slices.Equal(labels, expected) {
+		t.Errorf("customer message labels = %q, expected %q", labels, expected)
+	}
+
+	// Only the rules for agent messages apply when an agent mentions the same
+	// references.
+	links, labels = detectLinks(rules, text, true)
+	if expected := []string{"https://linear.app/beeper/issue/BE-9", "https://linear.app/beeper/issue/PLAT-22"}; !slices.Equal(links, expected) {
+		t.Errorf("agent message links = %q, expected %q", links, expected)
+	}
+	if len(labels) != 0 {
+		t.Errorf("agent message labels = %q, expected none", labels)
+	}
+
+	if links, labels := detectLinks(rules, "Thanks, that was all", false); len(links) != 0 || len(labels) != 0 {
+		t.Errorf("got links %q and labels %q for a message without references", links, labels)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// parseGeoURI parses the latitude and longitude out of a geo: URI (RFC 5870),
+// for example geo:51.5008,0.1247;u=35.
+func parseGeoURI(geoURI string) (lat, long float64, err error) {
+	coordinates, ok := strings.CutPrefix(geoURI, "geo:")
+	if !ok {
+		return 0, 0, fmt.Errorf("not a geo URI: %s", geoURI)
+	}
+	coordinates, _, _ = strings.Cut(coordinates, ";")
+	parts := strings.Split(coordinates, ",")
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("geo URI doesn't contain coordinates: %s", geoURI)
+	}
+	if lat, err = strconv.ParseFloat(parts[0], 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid latitude in geo URI: %w", err)
+	}
+	if long, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid longitude in geo URI: %w", err)
+	}
+	return lat, long, nil
+}
+
+func mapLinkForCoordinates(lat, long float64) string {
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%f&mlon=%f#map=16/%f/%f", lat, long, lat, long)
+}
+
+// formatLocationForChatwoot renders a Matrix location message as text with a
+// map link and the raw coordinates.
+func formatLocationForChatwoot(content *event.MessageEventContent) (string, error) {
+	lat, long, err := parseGeoURI(content.GeoURI)
+	if err != nil {
+		return "", err
+	}
+
+	text := "📍 **Location**"
+	if content.Body != "" && !strings.HasPrefix(content.Body, "geo:") {
+		text += ": " + content.Body
+	}
+	return fmt.Sprintf("%s\n\n%s\n\nCoordinates: %f, %f", text, mapLinkForCoordinates(lat, long), lat, long), nil
+}
+
+// sendLocationAttachment sends a Chatwoot location attachment to Matrix as an
+// m.location message.
+func sendLocationAttachment(ctx context.Context, roomID id.RoomID, chatwootMessageID chatwootapi.MessageID, chatwootAttachment chatwootapi.Attachment) (*mautrix.RespSendEvent, error) {
+	lat, long := chatwootAttachment.CoordinatesLat, chatwootAttachment.CoordinatesLong
+	body := fmt.Sprintf("Location: %f, %f", lat, long)
+	if chatwootAttachment.FallbackTitle != "" {
+		body = fmt.Sprintf("Location: %s (%f, %f)", chatwootAttachment.FallbackTitle, lat, long)
+	}
+
+	return SendMessage(ctx, roomID, &event.MessageEventContent{
+		MsgType: event.MsgLocation,
+		Body:    body,
+		GeoURI:  fmt.Sprintf("geo:%f,%f", lat, long),
+	}, map[string]any{
+		"com.beeper.chatwoot.message_id":    chatwootMessageID,
+		"com.beeper.chatwoot.attachment_id": chatwootAttachment.ID,
+	})
+}
+
+// sendContactAttachment sends a Chatwoot contact attachment to Matrix as a
+// text message.
+func sendContactAttachment(ctx context.Context, roomID id.RoomID, chatwootMessageID chatwootapi.MessageID, chatwootAttachment chatwootapi.Attachment) (*mautrix.RespSendEvent, error) {
+	return SendMessage(ctx, roomID, &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    fmt.Sprintf("Contact: %s", chatwootAttachment.FallbackTitle),
+	}, map[string]any{
+		"com.beeper.chatwoot.message_id":    chatwootMessageID,
+		"com.beeper.chatwoot.attachment_id": chatwootAttachment.ID,
+	})
+}
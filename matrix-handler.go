@@ -3,13 +3,14 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"regexp"
+	"net/http"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/sqlstatestore"
@@ -17,41 +18,55 @@ import (
 	"github.com/beeper/chatwoot/chatwootapi"
 )
 
-var createRoomLock sync.Mutex = sync.Mutex{}
-
-// getContactIdentifier returns the identifier to use for a contact in Chatwoot.
-// For Twitter users, this is the Twitter handle. For others, it falls back to the MXID.
-func getContactIdentifier(ctx context.Context, roomID id.RoomID, contactMXID id.UserID) string {
-	log := zerolog.Ctx(ctx)
+// keyedMutex is a set of mutexes that are identified by a key, so that work
+// on different keys doesn't block each other.
+type keyedMutex[K comparable] struct {
+	lock  sync.Mutex
+	locks map[K]*keyedMutexEntry
+}
 
-	// Special handling for Twitter users - use the Twitter handle
-	if strings.HasPrefix(contactMXID.Localpart(), "twitter_") {
-		memberEventContent := map[string]any{}
-		if err := client.StateEvent(ctx, roomID, event.StateMember, contactMXID.String(), &memberEventContent); err == nil {
-			log.Trace().Any("member_event_content", memberEventContent).Msg("Got member event content")
-			if identifiers, ok := memberEventContent["com.beeper.bridge.identifiers"]; ok {
-				if identifiersList, ok := identifiers.([]any); ok {
-					if len(identifiersList) == 1 {
-						if identifier, ok := identifiersList[0].(string); ok {
-							return "@" + strings.TrimPrefix(identifier, "twitter:")
-						}
-					}
-				}
-			}
-		}
-	}
+type keyedMutexEntry struct {
+	sync.Mutex
+	refs int
+}
 
-	// Special handling for iMessage bridges
-	if contactMXID.Homeserver() == "beeper.local" && strings.HasPrefix(contactMXID.Localpart(), "imessagego_1.") {
-		if decoded, err := id.DecodeUserLocalpart(strings.TrimPrefix(contactMXID.Localpart(), "imessagego_1.")); err == nil {
-			return decoded
+// Lock locks the mutex of the key and returns the function that unlocks it.
+func (m *keyedMutex[K]) Lock(key K) func() {
+	m.lock.Lock()
+	if m.locks == nil {
+		m.locks = map[K]*keyedMutexEntry{}
+	}
+	entry, ok := m.locks[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		m.locks[key] = entry
+	}
+	entry.refs++
+	m.lock.Unlock()
+
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		m.lock.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(m.locks, key)
 		}
+		m.lock.Unlock()
 	}
-
-	return contactMXID.String()
 }
 
-func createChatwootConversation(ctx context.Context, roomID id.RoomID, contactMXID id.UserID, customAttrs map[string]string) (chatwootapi.ConversationID, error) {
+// createRoomLocks makes sure that only one conversation is created per room.
+// contactLocks makes sure that only one contact is created per identifier.
+var (
+	createRoomLocks keyedMutex[id.RoomID]
+	contactLocks    keyedMutex[string]
+)
+
+// createChatwootConversation creates the conversation of the room and sets it
+// up. If the conversation was created, the room state that was fetched for the
+// setup is returned as well, so that callers don't need to fetch it again.
+func createChatwootConversation(ctx context.Context, roomID id.RoomID, contactMXID id.UserID, evt *event.Event, customAttrs map[string]string) (chatwootapi.ConversationID, mautrix.RoomStateMap, error) {
 	log := zerolog.Ctx(ctx).With().
 		Str("component", "create_chatwoot_conversation").
 		Stringer("room_id", roomID).
@@ -60,83 +75,119 @@ func createChatwootConversation(ctx context.Context, roomID id.RoomID, contactMX
 		Logger()
 	ctx = log.WithContext(ctx)
 
-	log.Debug().Msg("Acquired create room lock")
-	createRoomLock.Lock()
-	defer log.Debug().Msg("Released create room lock")
-	defer createRoomLock.Unlock()
+	conversationID, contactID, merge, err := createChatwootConversationForRoom(ctx, roomID, contactMXID, customAttrs)
+	if err != nil || contactID == 0 {
+		return conversationID, nil, err
+	}
+	log = log.With().Int("conversation_id", int(conversationID)).Logger()
+	ctx = log.WithContext(ctx)
 
-	if conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, roomID); err == nil {
-		return conversationID, nil
+	if merge != nil {
+		DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send contact merge note to %d", conversationID), func(ctx context.Context) (*chatwootapi.Message, error) {
+			return chatwootAPI.SendPrivateMessage(ctx, conversationID, merge.Note())
+		})
 	}
 
-	// Get the identifier to use for this contact (Twitter handle, iMessage identifier, or MXID)
-	contactIdentifier := getContactIdentifier(ctx, roomID, contactMXID)
-	log = log.With().Str("contact_identifier", contactIdentifier).Logger()
-	ctx = log.WithContext(ctx)
+	// The rest of the setup doesn't need the lock. The room state is fetched
+	// once and shared by all of it.
+	_, err = client.SendStateEvent(ctx, roomID, chatwootConversationIDType, "", ChatwootConversationIDEventContent{
+		ConversationID: conversationID,
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to send conversation_id state event")
+	}
 
-	contactID, err := chatwootAPI.ContactIDForIdentifier(ctx, contactIdentifier)
+	// The history doesn't need the room state, so it is backfilled even if
+	// fetching the state fails.
+	if configuration.Backfill.History.Enable {
+		if err = backfillHistoryForConversation(ctx, roomID, conversationID, evt); err != nil {
+			log.Warn().Err(err).Msg("failed to backfill history for conversation")
+		}
+	}
+
+	state, err := client.State(ctx, roomID)
 	if err != nil {
-		log.Warn().Err(err).Msg("contact ID not found for user, will attempt to create one")
+		log.Warn().Err(err).Msg("Failed to get room state to set up the conversation")
+		return conversationID, nil, nil
+	}
 
-		contactID, err = chatwootAPI.CreateContact(ctx, contactIdentifier)
-		if err != nil {
-			return 0, fmt.Errorf("create contact failed for %s: %w", contactMXID, err)
+	if configuration.ContactEnrichment.Enable {
+		if err = enrichContactFromState(ctx, roomID, contactMXID, contactID, state); err != nil {
+			log.Warn().Err(err).Msg("failed to enrich contact with Matrix profile")
 		}
-		log.Info().Int("contact_id", int(contactID)).Msg("Contact created")
 	}
 
-	log = log.With().Int("contact_id", int(contactID)).Logger()
+	if err = updateRoomAdditionalAttributes(ctx, conversationID, state); err != nil {
+		log.Warn().Err(err).Msg("Failed to set room additional attributes")
+	}
 
-	log.Info().Msg("creating Chatwoot conversation")
-	conversation, err := chatwootAPI.CreateConversation(ctx, roomID.String(), contactID, customAttrs)
-	if err != nil {
-		return 0, fmt.Errorf("failed to create chatwoot conversation for %s: %w", roomID, err)
+	if len(assignmentRules) > 0 || len(labelRules) > 0 {
+		info := getConversationInfo(contactMXID, state, evt)
+		applyAssignmentRules(ctx, conversationID, info)
+		scheduleConversationLabels(ctx, conversationID, info, evt)
 	}
-	log = log.With().Int("conversation_id", int(conversation.ID)).Logger()
-	ctx = log.WithContext(ctx)
 
-	err = stateStore.UpdateConversationIDForRoom(ctx, roomID, conversation.ID)
-	if err != nil {
-		return 0, err
+	return conversationID, state, nil
+}
+
+// createChatwootConversationForRoom creates the conversation of the room and
+// stores the mapping, unless the room already has a conversation. It returns
+// the contact of the conversation if it was created, or 0 if the room already
+// had a conversation, and the automatic merge of the contact if there was one.
+func createChatwootConversationForRoom(ctx context.Context, roomID id.RoomID, contactMXID id.UserID, customAttrs map[string]string) (chatwootapi.ConversationID, chatwootapi.ContactID, *contactMerge, error) {
+	log := zerolog.Ctx(ctx)
+
+	unlock := createRoomLocks.Lock(roomID)
+	defer unlock()
+
+	if conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, roomID); err == nil {
+		return conversationID, 0, nil, nil
 	}
 
-	_, err = client.SendStateEvent(ctx, roomID, chatwootConversationIDType, "", ChatwootConversationIDEventContent{
-		ConversationID: conversation.ID,
-	})
+	// Get the identifier to use for this contact (Twitter handle, iMessage identifier, or MXID)
+	contactIdentifier := getContactIdentifier(ctx, roomID, contactMXID)
+	ctx = log.With().Str("contact_identifier", contactIdentifier).Logger().WithContext(ctx)
+
+	contactID, merge, err := resolveContactIDLocked(ctx, roomID, contactMXID, contactIdentifier)
 	if err != nil {
-		log.Warn().Err(err).Msg("Failed to send conversation_id state event")
+		return 0, 0, nil, err
 	}
+	ctx = zerolog.Ctx(ctx).With().Int("contact_id", int(contactID)).Logger().WithContext(ctx)
+	log = zerolog.Ctx(ctx)
 
-	// Detect if this is the canonical DM
-	if configuration.CanonicalDMPrefix != "" {
-		var roomNameEvent event.RoomNameEventContent
-		err = client.StateEvent(ctx, roomID, event.StateRoomName, "", &roomNameEvent)
-		if err == nil {
-			if strings.HasPrefix(roomNameEvent.Name, configuration.CanonicalDMPrefix) {
-				go func() {
-					// Wait 30 seconds so that the new-user automation works
-					// and we don't race when adding canonical-dm.
-					time.Sleep(30 * time.Second)
-					log.Info().Msg("Adding canonical-dm label to conversation")
-
-					labels, err := chatwootAPI.GetConversationLabels(ctx, conversation.ID)
-					if err != nil {
-						log.Err(err).Msg("Failed to list conversation labels")
-					}
-					log.Debug().Msg("Got current conversation labels")
-					labels = append(labels, "canonical-dm")
-
-					log.Info().Strs("labels", labels).Msg("Setting conversation labels")
-					err = chatwootAPI.SetConversationLabels(ctx, conversation.ID, labels)
-					if err != nil {
-						log.Err(err).Msg("failed to add canonical-dm label to conversation")
-					}
-				}()
-			}
+	log.Info().Msg("creating Chatwoot conversation")
+	conversation, err := chatwootAPI.CreateConversation(ctx, roomID.String(), contactID, customAttrs)
+	var chatwootErr *chatwootapi.Error
+	if errors.As(err, &chatwootErr) && chatwootErr.StatusCode == http.StatusNotFound {
+		// The cached contact may have been deleted in Chatwoot, so look it up
+		// again.
+		log.Warn().Err(err).Msg("contact not found, resolving it again")
+		if err = stateStore.DeleteCachedContactID(ctx, contactIdentifier); err != nil {
+			return 0, 0, nil, fmt.Errorf("failed to delete cached contact ID for %s: %w", contactIdentifier, err)
 		}
+		contactID, merge, err = resolveContactIDLocked(ctx, roomID, contactMXID, contactIdentifier)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		conversation, err = chatwootAPI.CreateConversation(ctx, roomID.String(), contactID, customAttrs)
+	}
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("failed to create chatwoot conversation for %s: %w", roomID, err)
 	}
 
-	return conversation.ID, nil
+	if err = stateStore.UpdateConversationIDForRoom(ctx, roomID, conversation.ID); err != nil {
+		return 0, 0, nil, err
+	}
+	return conversation.ID, contactID, merge, nil
+}
+
+// resolveContactIDLocked resolves the contact ID while holding the lock of
+// the identifier, so that concurrent conversations with the same customer
+// don't create duplicate contacts.
+func resolveContactIDLocked(ctx context.Context, roomID id.RoomID, contactMXID id.UserID, contactIdentifier string) (chatwootapi.ContactID, *contactMerge, error) {
+	unlock := contactLocks.Lock(contactIdentifier)
+	defer unlock()
+	return resolveContactID(ctx, roomID, contactMXID, contactIdentifier)
 }
 
 func GetCustomAttrForDevice(ctx context.Context, evt *event.Event) (string, string) {
@@ -178,71 +229,28 @@ func GetCustomAttrForDevice(ctx context.Context, evt *event.Event) (string, stri
 	return clientTypeString, clientVersionString
 }
 
-var rageshakeIssueRegex = regexp.MustCompile(`[A-Z]{1,5}-\d+`)
-
 func HandleMessage(ctx context.Context, evt *event.Event) {
 	log := zerolog.Ctx(ctx).With().Str("component", "handle_message").Logger()
 	ctx = log.WithContext(ctx)
 
-	// Acquire the lock, so that we don't have race conditions with the
-	// Chatwoot handler.
-	if _, found := roomSendlocks[evt.RoomID]; !found {
-		log.Debug().Msg("creating send lock")
-		roomSendlocks[evt.RoomID] = &sync.Mutex{}
-	}
-	roomSendlocks[evt.RoomID].Lock()
-	log.Debug().Msg("acquired send lock")
-	defer log.Debug().Msg("released send lock")
-	defer roomSendlocks[evt.RoomID].Unlock()
-
 	if messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, evt.ID); err == nil && len(messageIDs) > 0 {
 		log.Info().Any("message_ids", messageIDs).Msg("event already has chatwoot messages")
 		return
 	}
 
-	conversationID, err := GetOrCreateChatwootConversation(ctx, evt.RoomID, evt)
+	conversationID, state, err := getOrCreateChatwootConversation(ctx, evt.RoomID, evt)
 	if err != nil {
 		log.Err(err).Msg("failed to get or create Chatwoot conversation")
 		return
 	}
 
-	// Asynchronously update the conversation attributes
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-		conversation, err := chatwootAPI.GetChatwootConversation(ctx, conversationID)
-		if err != nil {
-			log.Err(err).Msg("failed to get conversation to update custom attributes")
-			return
-		}
-		newCustomAttributes := map[string]string{}
-		attrWhitelist := []string{
-			"reason",
-			"category",
-			"subcategory",
-			"client",
-			"network",
-			"internal_note",
-		}
-		for _, attr := range attrWhitelist {
-			if val, ok := conversation.CustomAttributes[attr]; ok {
-				newCustomAttributes[attr] = val
-			} else {
-				newCustomAttributes[attr] = ""
-			}
-		}
-		if err := chatwootAPI.SetConversationCustomAttributes(ctx, conversationID, newCustomAttributes); err != nil {
-			log.Err(err).Msg("failed to set conversation custom attributes")
-		}
-	}()
-
-	cm, err := DoRetryArr(ctx, fmt.Sprintf("handle matrix event %s in conversation %d", evt.ID, conversationID), func(context.Context) ([]*chatwootapi.Message, error) {
+	cm, err := DoRetryArr(ctx, RetryChatwootSend, fmt.Sprintf("handle matrix event %s in conversation %d", evt.ID, conversationID), func(context.Context) ([]*chatwootapi.Message, error) {
 		content := evt.Content.AsMessage()
 		messages, err := HandleMatrixMessageContent(ctx, evt, conversationID, content)
 		return messages, err
 	})
 	if err != nil {
-		DoRetry(ctx, fmt.Sprintf("send private error message to %d for %+v", conversationID, err), func(ctx context.Context) (*chatwootapi.Message, error) {
+		DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send private error message to %d for %+v", conversationID, err), func(ctx context.Context) (*chatwootapi.Message, error) {
 			msg, err := chatwootAPI.SendPrivateMessage(
 				ctx,
 				conversationID,
@@ -258,30 +266,47 @@ func HandleMessage(ctx context.Context, evt *event.Event) {
 	for _, m := range cm {
 		stateStore.SetChatwootMessageIDForMatrixEvent(ctx, evt.ID, m.ID)
 	}
+
+	// The message is bridged first, so that it doesn't wait for the room
+	// state and the conversation updates.
+	UpdateCustomAttributes(ctx, conversationID, evt.RoomID, evt, state)
+	scheduleMessageLabels(ctx, conversationID, evt)
+
 	content := evt.Content.AsMessage()
+	if evt.Sender != configuration.Username && (content.MsgType == event.MsgText || content.MsgType == event.MsgNotice) &&
+		(content.RelatesTo == nil || content.RelatesTo.Type != event.RelReplace) {
+		handleCSATReply(ctx, evt, content)
+	}
 	if content.MsgType == event.MsgText || content.MsgType == event.MsgNotice {
-		linearLinks := []string{}
-		for _, match := range rageshakeIssueRegex.FindAllString(content.Body, -1) {
-			linearLinks = append(linearLinks, fmt.Sprintf("https://linear.app/beeper/issue/%s", match))
-		}
-		if len(linearLinks) > 0 {
-			chatwootAPI.SendPrivateMessage(ctx, conversationID, strings.Join(linearLinks, "\n\n"))
-		}
+		applyLinkRules(ctx, conversationID, content.Body, false)
 	}
 }
 
 func GetOrCreateChatwootConversation(ctx context.Context, roomID id.RoomID, evt *event.Event) (chatwootapi.ConversationID, error) {
+	conversationID, _, err := getOrCreateChatwootConversation(ctx, roomID, evt)
+	return conversationID, err
+}
+
+// getOrCreateChatwootConversation is GetOrCreateChatwootConversation, but it
+// also returns the room state if it was fetched to create the conversation.
+func getOrCreateChatwootConversation(ctx context.Context, roomID id.RoomID, evt *event.Event) (chatwootapi.ConversationID, mautrix.RoomStateMap, error) {
 	log := zerolog.Ctx(ctx).With().Str("method", "GetOrCreateChatwootConversation").Logger()
 
 	conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, roomID)
 	if err == nil {
-		return conversationID, nil
+		return conversationID, nil, nil
+	}
+
+	// The conversation of an upgraded room was moved to the replacement room,
+	// so late events in the old room must not create a new conversation.
+	if newRoomID, err := stateStore.GetReplacementRoom(ctx, roomID); err == nil {
+		return -1, nil, fmt.Errorf("not creating Chatwoot conversation for room that was upgraded to %s", newRoomID)
 	}
 
 	for i := 0; i < 2; i++ {
 		joinedMembers, err := client.StateStore.(*sqlstatestore.SQLStateStore).GetRoomMembers(ctx, roomID, event.MembershipJoin)
 		if err != nil {
-			return -1, fmt.Errorf("failed to get joined members for room %s: %w", roomID, err)
+			return -1, nil, fmt.Errorf("failed to get joined members for room %s: %w", roomID, err)
 		}
 		memberCount := len(joinedMembers)
 
@@ -290,7 +315,7 @@ func GetOrCreateChatwootConversation(ctx context.Context, roomID id.RoomID, evt
 				Int("member_count", memberCount).
 				Int("bridge_if_members_less_than", configuration.BridgeIfMembersLessThan).
 				Msg("not creating Chatwoot conversation for room with too many members")
-			return -1, fmt.Errorf("not creating Chatwoot conversation for room with %d members", memberCount)
+			return -1, nil, fmt.Errorf("not creating Chatwoot conversation for room with %d members", memberCount)
 		}
 
 		contactMXID := evt.Sender
@@ -306,7 +331,7 @@ func GetOrCreateChatwootConversation(ctx context.Context, roomID id.RoomID, evt
 				// an updated set of users.
 				membersResp, err := client.JoinedMembers(ctx, roomID)
 				if err != nil {
-					return -1, fmt.Errorf("failed to get joined members to verify if this conversation is a non-DM room: %w", err)
+					return -1, nil, fmt.Errorf("failed to get joined members to verify if this conversation is a non-DM room: %w", err)
 				}
 
 				if len(membersResp.Joined) == 1 {
@@ -328,9 +353,9 @@ func GetOrCreateChatwootConversation(ctx context.Context, roomID id.RoomID, evt
 		if deviceTypeKey != "" && deviceVersion != "" {
 			customAttrs[deviceTypeKey] = deviceVersion
 		}
-		return createChatwootConversation(ctx, evt.RoomID, contactMXID, customAttrs)
+		return createChatwootConversation(ctx, evt.RoomID, contactMXID, evt, customAttrs)
 	}
-	return -1, fmt.Errorf("failed to create Chatwoot conversation for room %s", roomID)
+	return -1, nil, fmt.Errorf("failed to create Chatwoot conversation for room %s", roomID)
 }
 
 func HandleReaction(ctx context.Context, evt *event.Event) {
@@ -341,46 +366,31 @@ func HandleReaction(ctx context.Context, evt *event.Event) {
 		Logger()
 	ctx = log.WithContext(ctx)
 
-	// Acquire the lock, so that we don't have race conditions with the
-	// Chatwoot handler.
-	if _, found := roomSendlocks[evt.RoomID]; !found {
-		log.Debug().Msg("creating send lock")
-		roomSendlocks[evt.RoomID] = &sync.Mutex{}
-	}
-	roomSendlocks[evt.RoomID].Lock()
-	log.Debug().Msg("acquiring send lock")
-	defer log.Debug().Msg("released send lock")
-	defer roomSendlocks[evt.RoomID].Unlock()
-
 	if messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, evt.ID); err == nil && len(messageIDs) > 0 {
 		log.Info().Any("message_ids", messageIDs).Msg("event already has chatwoot messages")
 		return
 	}
 
+	if handleCSATReaction(ctx, evt) {
+		return
+	}
+
 	conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, evt.RoomID)
 	if err != nil {
 		log.Err(err).Msg("no existing Chatwoot conversation found")
 		return
 	}
 
-	cm, err := DoRetry(ctx, fmt.Sprintf("send notification of reaction to %d", conversationID), func(context.Context) (*chatwootapi.Message, error) {
+	cm, err := DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send notification of reaction to %d", conversationID), func(context.Context) (*chatwootapi.Message, error) {
 		reaction := evt.Content.AsReaction()
 		reactedEvent, err := client.GetEvent(ctx, evt.RoomID, reaction.RelatesTo.EventID)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't find reacted to event %s: %w", reaction.RelatesTo.EventID, err)
 		}
 
-		if reactedEvent.Type == event.EventEncrypted {
-			err := reactedEvent.Content.ParseRaw(reactedEvent.Type)
-			if err != nil {
-				return nil, err
-			}
-
-			decryptedEvent, err := client.Crypto.Decrypt(ctx, reactedEvent)
-			if err != nil {
-				return nil, err
-			}
-			reactedEvent = decryptedEvent
+		reactedEvent, err = parseFetchedEvent(ctx, reactedEvent)
+		if err != nil {
+			return nil, err
 		}
 
 		reactedMessage := reactedEvent.Content.AsMessage()
@@ -399,7 +409,7 @@ func HandleReaction(ctx context.Context, evt *event.Event) {
 			chatwootapi.IncomingMessage)
 	})
 	if err != nil {
-		DoRetry(ctx, fmt.Sprintf("send private error message to %d for %+v", conversationID, err), func(ctx context.Context) (*chatwootapi.Message, error) {
+		DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send private error message to %d for %+v", conversationID, err), func(ctx context.Context) (*chatwootapi.Message, error) {
 			return chatwootAPI.SendPrivateMessage(
 				ctx,
 				conversationID,
@@ -410,6 +420,24 @@ func HandleReaction(ctx context.Context, evt *event.Event) {
 	stateStore.SetChatwootMessageIDForMatrixEvent(ctx, evt.ID, (*cm).ID)
 }
 
+// parseFetchedEvent parses the content of an event that was fetched from the
+// server (rather than received via sync), decrypting it if necessary.
+func parseFetchedEvent(ctx context.Context, evt *event.Event) (*event.Event, error) {
+	err := evt.Content.ParseRaw(evt.Type)
+	if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return nil, err
+	}
+
+	if evt.Type == event.EventEncrypted {
+		decryptedEvent, err := client.Crypto.Decrypt(ctx, evt)
+		if err != nil {
+			return nil, err
+		}
+		return decryptedEvent, nil
+	}
+	return evt, nil
+}
+
 func downloadAndDecryptMedia(ctx context.Context, content *event.MessageEventContent) ([]byte, error) {
 	var file *event.EncryptedFileInfo
 	rawMXC := content.URL
@@ -454,6 +482,14 @@ func HandleMatrixMessageContent(ctx context.Context, evt *event.Event, conversat
 	case event.MsgText, event.MsgNotice:
 		relatesTo := content.RelatesTo
 		body := content.Body
+		if messageType == chatwootapi.IncomingMessage && (relatesTo == nil || relatesTo.Type != event.RelReplace) {
+			cm, err := handleInteractiveReply(ctx, evt.RoomID, conversationID, body)
+			if err != nil {
+				return nil, err
+			} else if cm != nil {
+				return []*chatwootapi.Message{cm}, nil
+			}
+		}
 		if relatesTo != nil && relatesTo.Type == event.RelReplace {
 			if strings.HasPrefix(body, " * ") {
 				body = " \\* " + body[3:]
@@ -467,12 +503,28 @@ func HandleMatrixMessageContent(ctx context.Context, evt *event.Event, conversat
 		cm, err := chatwootAPI.SendTextMessage(ctx, conversationID, fmt.Sprintf(" \\* %s %s", localpart, content.Body), messageType)
 		return []*chatwootapi.Message{cm}, err
 
+	case event.MsgLocation:
+		text, err := formatLocationForChatwoot(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse location in %s: %w", evt.ID, err)
+		}
+		cm, err := chatwootAPI.SendTextMessage(ctx, conversationID, text, messageType)
+		return []*chatwootapi.Message{cm}, err
+
 	case event.MsgAudio, event.MsgFile, event.MsgImage, event.MsgVideo:
 		data, err := downloadAndDecryptMedia(ctx, content)
 		if err != nil {
 			return nil, fmt.Errorf("failed to download and decrypt media in %s: %w", evt.ID, err)
 		}
 
+		if isVCard(content) {
+			if cards := parseVCards(string(data)); len(cards) > 0 {
+				cm, err := chatwootAPI.SendTextMessage(ctx, conversationID, formatVCardsForChatwoot(cards), messageType)
+				return []*chatwootapi.Message{cm}, err
+			}
+			log.Warn().Msg("no contacts found in vCard, sending as a file")
+		}
+
 		filename := content.Body
 		caption := ""
 		if content.FileName != "" {
@@ -550,17 +602,6 @@ func HandleRedaction(ctx context.Context, evt *event.Event) {
 		Logger()
 	ctx = log.WithContext(ctx)
 
-	// Acquire the lock, so that we don't have race conditions with the
-	// Chatwoot handler.
-	if _, found := roomSendlocks[evt.RoomID]; !found {
-		log.Debug().Msg("creating send lock")
-		roomSendlocks[evt.RoomID] = &sync.Mutex{}
-	}
-	roomSendlocks[evt.RoomID].Lock()
-	log.Debug().Msg("acquired send lock")
-	defer log.Debug().Msg("released send lock")
-	defer roomSendlocks[evt.RoomID].Unlock()
-
 	messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, evt.Redacts)
 	if err != nil || len(messageIDs) == 0 {
 		log.Err(err).Stringer("redacts", evt.Redacts).Msg("no Chatwoot message for redacted event")
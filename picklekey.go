@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/crypto/goolm/libolmpickle"
+)
+
+// pickledColumns are the columns of the crypto store that are encrypted with
+// the pickle key, along with the column that identifies the row within an
+// account.
+var pickledColumns = []struct {
+	table        string
+	idColumn     string
+	pickleColumn string
+}{
+	{"crypto_account", "account_id", "account"},
+	{"crypto_olm_session", "session_id", "session"},
+	{"crypto_megolm_inbound_session", "session_id", "session"},
+	{"crypto_megolm_outbound_session", "room_id", "session"},
+	{"crypto_secrets", "name", "secret"},
+}
+
+type pickledRow struct {
+	id      string
+	pickled []byte
+}
+
+// migratePickleKey re-encrypts the crypto account, Olm and Megolm sessions and
+// secrets of the given account from the old pickle key to the new one. All
+// rows are migrated in a single transaction, so if any row can't be decrypted
+// with the old key, nothing is changed.
+func migratePickleKey(ctx context.Context, db *dbutil.Database, accountID string, oldKey, newKey []byte) error {
+	log := zerolog.Ctx(ctx).With().Str("component", "migrate_pickle_key").Logger()
+	ctx = log.WithContext(ctx)
+
+	return db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, column := range pickledColumns {
+			rows, err := db.Query(ctx, fmt.Sprintf(
+				"SELECT %s, %s FROM %s WHERE account_id = $1 AND %s IS NOT NULL",
+				column.idColumn, column.pickleColumn, column.table, column.pickleColumn,
+			), accountID)
+			if err != nil {
+				return fmt.Errorf("failed to query %s: %w", column.table, err)
+			}
+			var pickledRows []pickledRow
+			for rows.Next() {
+				var row pickledRow
+				if err = rows.Scan(&row.id, &row.pickled); err != nil {
+					rows.Close()
+					return fmt.Errorf("failed to scan %s: %w", column.table, err)
+				}
+				pickledRows = append(pickledRows, row)
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				return fmt.Errorf("failed to read %s: %w", column.table, err)
+			}
+
+			for _, row := range pickledRows {
+				plaintext, err := libolmpickle.Unpickle(oldKey, row.pickled)
+				if err != nil {
+					return fmt.Errorf("failed to unpickle %s %s with the old key: %w", column.table, row.id, err)
+				}
+				repickled, err := libolmpickle.Pickle(newKey, plaintext)
+				if err != nil {
+					return fmt.Errorf("failed to pickle %s %s with the new key: %w", column.table, row.id, err)
+				}
+				_, err = db.Exec(ctx, fmt.Sprintf(
+					"UPDATE %s SET %s = $3 WHERE account_id = $1 AND %s = $2",
+					column.table, column.pickleColumn, column.idColumn,
+				), accountID, row.id, repickled)
+				if err != nil {
+					return fmt.Errorf("failed to update %s %s: %w", column.table, row.id, err)
+				}
+			}
+			log.Info().Str("table", column.table).Int("count", len(pickledRows)).Msg("re-pickled rows")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// pollEndEventContent is the content of an MSC3381 poll end event. mautrix
+// does not have a struct for it, so it is parsed manually.
+type pollEndEventContent struct {
+	RelatesTo event.RelatesTo `json:"m.relates_to"`
+	Text      string          `json:"org.matrix.msc1767.text"`
+}
+
+func pollQuestion(poll *event.PollStartEventContent) string {
+	if poll.PollStart.Question.Text != "" {
+		return poll.PollStart.Question.Text
+	}
+	for _, message := range poll.PollStart.Question.Message {
+		if message.Body != "" {
+			return message.Body
+		}
+	}
+	return "(no question)"
+}
+
+func pollAnswerTexts(poll *event.PollStartEventContent) map[string]string {
+	answers := map[string]string{}
+	for _, answer := range poll.PollStart.Answers {
+		text := answer.Text
+		if text == "" {
+			for _, message := range answer.Message {
+				if message.Body != "" {
+					text = message.Body
+					break
+				}
+			}
+		}
+		answers[answer.ID] = text
+	}
+	return answers
+}
+
+// getPollStart fetches the poll that a response or end event refers to.
+func getPollStart(ctx context.Context, roomID id.RoomID, pollEventID id.EventID) (*event.PollStartEventContent, error) {
+	pollEvent, err := client.GetEvent(ctx, roomID, pollEventID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find poll start event %s: %w", pollEventID, err)
+	}
+	pollEvent, err = parseFetchedEvent(ctx, pollEvent)
+	if err != nil {
+		return nil, err
+	}
+	poll, ok := pollEvent.Content.Parsed.(*event.PollStartEventContent)
+	if !ok {
+		return nil, fmt.Errorf("event %s is not a poll start event", pollEventID)
+	}
+	return poll, nil
+}
+
+func sendPollErrorMessage(ctx context.Context, conversationID chatwootapi.ConversationID, err error) {
+	DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send private error message to %d for %+v", conversationID, err), func(ctx context.Context) (*chatwootapi.Message, error) {
+		return chatwootAPI.SendPrivateMessage(
+			ctx,
+			conversationID,
+			fmt.Sprintf("**Error occurred while receiving a Matrix poll. You may have missed a poll update!**\n\nError: %+v", err))
+	})
+}
+
+func HandlePollStart(ctx context.Context, evt *event.Event) {
+	log := zerolog.Ctx(ctx).With().Str("component", "handle_poll_start").Logger()
+	ctx = log.WithContext(ctx)
+
+	if messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, evt.ID); err == nil && len(messageIDs) > 0 {
+		log.Info().Any("message_ids", messageIDs).Msg("event already has chatwoot messages")
+		return
+	}
+
+	conversationID, err := GetOrCreateChatwootConversation(ctx, evt.RoomID, evt)
+	if err != nil {
+		log.Err(err).Msg("failed to get or create Chatwoot conversation")
+		return
+	}
+
+	poll, ok := evt.Content.Parsed.(*event.PollStartEventContent)
+	if !ok {
+		log.Warn().Msg("poll start event content was not parsed")
+		return
+	}
+	answerTexts := pollAnswerTexts(poll)
+	var answers []string
+	for i, answer := range poll.PollStart.Answers {
+		answers = append(answers, fmt.Sprintf("%d. %s", i+1, answerTexts[answer.ID]))
+	}
+	text := fmt.Sprintf("📊 **Poll:** %s\n\n%s", pollQuestion(poll), strings.Join(answers, "\n"))
+	if poll.PollStart.MaxSelections > 1 {
+		text += fmt.Sprintf("\n\n_Up to %d answers can be selected._", poll.PollStart.MaxSelections)
+	}
+
+	messageType := chatwootapi.IncomingMessage
+	if configuration.Username == evt.Sender {
+		messageType = chatwootapi.OutgoingMessage
+	}
+	cm, err := DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send poll %s to %d", evt.ID, conversationID), func(ctx context.Context) (*chatwootapi.Message, error) {
+		return chatwootAPI.SendTextMessage(ctx, conversationID, text, messageType)
+	})
+	if err != nil {
+		sendPollErrorMessage(ctx, conversationID, err)
+		return
+	}
+	stateStore.SetChatwootMessageIDForMatrixEvent(ctx, evt.ID, cm.ID)
+}
+
+func HandlePollResponse(ctx context.Context, evt *event.Event) {
+	log := zerolog.Ctx(ctx).With().Str("component", "handle_poll_response").Logger()
+	ctx = log.WithContext(ctx)
+
+	if messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, evt.ID); err == nil && len(messageIDs) > 0 {
+		log.Info().Any("message_ids", messageIDs).Msg("event already has chatwoot messages")
+		return
+	}
+
+	conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, evt.RoomID)
+	if err != nil {
+		log.Err(err).Msg("no existing Chatwoot conversation found")
+		return
+	}
+
+	response, ok := evt.Content.Parsed.(*event.PollResponseEventContent)
+	if !ok {
+		log.Warn().Msg("poll response event content was not parsed")
+		return
+	}
+	pollEventID := response.RelatesTo.EventID
+	err = stateStore.SetPollResponse(ctx, pollEventID, evt.Sender, response.Response.Answers, time.UnixMilli(evt.Timestamp))
+	if err != nil {
+		log.Err(err).Msg("failed to store poll response")
+	}
+
+	cm, err := DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send notification of poll response to %d", conversationID), func(ctx context.Context) (*chatwootapi.Message, error) {
+		poll, err := getPollStart(ctx, evt.RoomID, pollEventID)
+		if err != nil {
+			return nil, err
+		}
+
+		var text string
+		if len(response.Response.Answers) == 0 {
+			text = fmt.Sprintf("%s removed their vote in poll \"%s\"", evt.Sender, pollQuestion(poll))
+		} else {
+			answerTexts := pollAnswerTexts(poll)
+			var answers []string
+			for _, answerID := range response.Response.Answers {
+				if answerText, ok := answerTexts[answerID]; ok {
+					answers = append(answers, fmt.Sprintf("\"%s\"", answerText))
+				}
+			}
+			text = fmt.Sprintf("%s voted for %s in poll \"%s\"", evt.Sender, strings.Join(answers, ", "), pollQuestion(poll))
+		}
+		return chatwootAPI.SendTextMessage(ctx, conversationID, text, chatwootapi.IncomingMessage)
+	})
+	if err != nil {
+		sendPollErrorMessage(ctx, conversationID, err)
+		return
+	}
+	stateStore.SetChatwootMessageIDForMatrixEvent(ctx, evt.ID, cm.ID)
+}
+
+func HandlePollEnd(ctx context.Context, evt *event.Event) {
+	log := zerolog.Ctx(ctx).With().Str("component", "handle_poll_end").Logger()
+	ctx = log.WithContext(ctx)
+
+	if messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, evt.ID); err == nil && len(messageIDs) > 0 {
+		log.Info().Any("message_ids", messageIDs).Msg("event already has chatwoot messages")
+		return
+	}
+
+	conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, evt.RoomID)
+	if err != nil {
+		log.Err(err).Msg("no existing Chatwoot conversation found")
+		return
+	}
+
+	var content pollEndEventContent
+	if err = json.Unmarshal(evt.Content.VeryRaw, &content); err != nil {
+		log.Err(err).Msg("failed to parse poll end event")
+		return
+	}
+	pollEventID := content.RelatesTo.EventID
+
+	messageType := chatwootapi.IncomingMessage
+	if configuration.Username == evt.Sender {
+		messageType = chatwootapi.OutgoingMessage
+	}
+	cm, err := DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send poll results to %d", conversationID), func(ctx context.Context) (*chatwootapi.Message, error) {
+		poll, err := getPollStart(ctx, evt.RoomID, pollEventID)
+		if err != nil {
+			return nil, err
+		}
+		responses, err := stateStore.GetPollResponses(ctx, pollEventID, time.UnixMilli(evt.Timestamp))
+		if err != nil {
+			return nil, err
+		}
+
+		// Tally the votes. Only known answers count, and only up to the
+		// maximum number of selections per voter.
+		answerTexts := pollAnswerTexts(poll)
+		maxSelections := max(poll.PollStart.MaxSelections, 1)
+		tally := map[string]int{}
+		voters := 0
+		for _, answers := range responses {
+			counted := 0
+			for _, answerID := range answers {
+				if _, ok := answerTexts[answerID]; !ok || counted >= maxSelections {
+					continue
+				}
+				tally[answerID]++
+				counted++
+			}
+			if counted > 0 {
+				voters++
+			}
+		}
+
+		var results []string
+		for _, answer := range poll.PollStart.Answers {
+			votes := "votes"
+			if tally[answer.ID] == 1 {
+				votes = "vote"
+			}
+			results = append(results, fmt.Sprintf("- %s: %d %s", answerTexts[answer.ID], tally[answer.ID], votes))
+		}
+		text := fmt.Sprintf("📊 **Poll ended:** %s\n\n%s\n\nTotal voters: %d", pollQuestion(poll), strings.Join(results, "\n"), voters)
+		return chatwootAPI.SendTextMessage(ctx, conversationID, text, messageType)
+	})
+	if err != nil {
+		sendPollErrorMessage(ctx, conversationID, err)
+		return
+	}
+	stateStore.SetChatwootMessageIDForMatrixEvent(ctx, evt.ID, cm.ID)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sethvargo/go-retry"
+)
+
+// RetryClass is the class of operation that is retried. Each class has its
+// own retry policy and metrics.
+type RetryClass string
+
+const (
+	RetryMatrixSend    RetryClass = "matrix_send"
+	RetryChatwootSend  RetryClass = "chatwoot_send"
+	RetryMediaDownload RetryClass = "media_download"
+)
+
+var retryClasses = []RetryClass{RetryMatrixSend, RetryChatwootSend, RetryMediaDownload}
+
+func (p RetryPolicy) Backoff() retry.Backoff {
+	b := retry.NewFibonacci(max(p.InitialInterval, time.Millisecond))
+	if p.JitterPercent > 0 {
+		b = retry.WithJitterPercent(p.JitterPercent, b)
+	}
+	b = retry.WithMaxRetries(p.MaxRetries, b)
+	if p.MaxElapsedTime > 0 {
+		b = retry.WithMaxDuration(p.MaxElapsedTime, b)
+	}
+	return b
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	InitialInterval: 1 * time.Second,
+	MaxRetries:      5,
+	MaxElapsedTime:  5 * time.Minute,
+	JitterPercent:   10,
+}
+
+// RetryMetrics counts the attempts made for a class of operations.
+type RetryMetrics struct {
+	// Attempts is the total number of attempts, including the first one.
+	Attempts atomic.Uint64
+	// Retries is the number of attempts after the first one.
+	Retries atomic.Uint64
+	// Successes is the number of operations that eventually succeeded.
+	Successes atomic.Uint64
+	// Failures is the number of operations that were given up on.
+	Failures atomic.Uint64
+}
+
+var retryMetrics = map[RetryClass]*RetryMetrics{
+	RetryMatrixSend:    {},
+	RetryChatwootSend:  {},
+	RetryMediaDownload: {},
+}
+
+// unknownRetryMetrics collects the metrics of operations without a known
+// class.
+var unknownRetryMetrics RetryMetrics
+
+func retryMetricsFor(class RetryClass) *RetryMetrics {
+	if metrics, ok := retryMetrics[class]; ok {
+		return metrics
+	}
+	return &unknownRetryMetrics
+}
+
+// HandleRetryMetrics serves the retry metrics in the Prometheus text format.
+func HandleRetryMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	counters := []struct {
+		name  string
+		help  string
+		value func(*RetryMetrics) uint64
+	}{
+		{"chatwoot_bot_retry_attempts_total", "Total number of attempts of retried operations.", func(m *RetryMetrics) uint64 { return m.Attempts.Load() }},
+		{"chatwoot_bot_retry_retries_total", "Number of attempts after the first one.", func(m *RetryMetrics) uint64 { return m.Retries.Load() }},
+		{"chatwoot_bot_retry_successes_total", "Number of operations that eventually succeeded.", func(m *RetryMetrics) uint64 { return m.Successes.Load() }},
+		{"chatwoot_bot_retry_failures_total", "Number of operations that were given up on.", func(m *RetryMetrics) uint64 { return m.Failures.Load() }},
+	}
+	for _, counter := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+		for _, class := range retryClasses {
+			fmt.Fprintf(w, "%s{class=%q} %d\n", counter.name, class, counter.value(retryMetrics[class]))
+		}
+	}
+}
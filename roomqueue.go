@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// RoomQueue processes the jobs for each room in the order in which they were
+// queued. Jobs for different rooms run concurrently, but at most maxWorkers
+// jobs run at the same time.
+//
+// Both the Matrix and the Chatwoot handlers queue their work here, so that
+// they don't race with each other when bridging into the same room.
+type RoomQueue struct {
+	lock    sync.Mutex
+	queues  map[id.RoomID][]func()
+	workers chan struct{}
+	// idle is closed when the last queue becomes empty. It is nil while
+	// there are no queued jobs.
+	idle chan struct{}
+}
+
+var roomQueue *RoomQueue
+
+func NewRoomQueue(maxWorkers int) *RoomQueue {
+	return &RoomQueue{
+		queues:  map[id.RoomID][]func(){},
+		workers: make(chan struct{}, max(maxWorkers, 1)),
+	}
+}
+
+// Enqueue adds a job to the queue of the given room. The job runs after all
+// jobs that were previously queued for the room have finished.
+func (q *RoomQueue) Enqueue(roomID id.RoomID, job func()) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.idle == nil {
+		q.idle = make(chan struct{})
+	}
+	queue, running := q.queues[roomID]
+	q.queues[roomID] = append(queue, job)
+	if !running {
+		go q.work(roomID)
+	}
+}
+
+// work runs the jobs of the given room until its queue is empty. There is at
+// most one worker per room.
+func (q *RoomQueue) work(roomID id.RoomID) {
+	for {
+		q.lock.Lock()
+		queue := q.queues[roomID]
+		if len(queue) == 0 {
+			delete(q.queues, roomID)
+			if len(q.queues) == 0 {
+				close(q.idle)
+				q.idle = nil
+			}
+			q.lock.Unlock()
+			return
+		}
+		job := queue[0]
+		q.queues[roomID] = queue[1:]
+		q.lock.Unlock()
+
+		q.workers <- struct{}{}
+		job()
+		<-q.workers
+	}
+}
+
+// Drain waits until all queued jobs have finished, or until the context is
+// done.
+func (q *RoomQueue) Drain(ctx context.Context) error {
+	for {
+		q.lock.Lock()
+		idle := q.idle
+		q.lock.Unlock()
+		if idle == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			q.lock.Lock()
+			remaining := len(q.queues)
+			q.lock.Unlock()
+			return fmt.Errorf("%d rooms still have queued jobs: %w", remaining, ctx.Err())
+		case <-idle:
+			// Jobs may have been queued again since the queue became idle,
+			// so check again.
+		}
+	}
+}
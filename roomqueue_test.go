@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRoomQueueRunsJobsInOrder(t *testing.T) {
+	q := NewRoomQueue(4)
+	roomID := id.RoomID("!room:example.com")
+
+	var lock sync.Mutex
+	var order []int
+	for i := range 100 {
+		q.Enqueue(roomID, func() {
+			lock.Lock()
+			order = append(order, i)
+			lock.Unlock()
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	if len(order) != 100 {
+		t.Fatalf("ran %d jobs, expected 100", len(order))
+	}
+	for i, job := range order {
+		if job != i {
+			t.Fatalf("job %d ran at position %d", job, i)
+		}
+	}
+}
+
+func TestRoomQueueRunsRoomsConcurrently(t *testing.T) {
+	q := NewRoomQueue(2)
+
+	// Each job waits for the job of the other room, so this only finishes if
+	// both rooms are processed at the same time.
+	var started sync.WaitGroup
+	started.Add(2)
+	for _, roomID := range []id.RoomID{"!a:example.com", "!b:example.com"} {
+		q.Enqueue(roomID, func() {
+			started.Done()
+			started.Wait()
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+}
+
+func TestRoomQueueLimitsWorkers(t *testing.T) {
+	const maxWorkers = 3
+	q := NewRoomQueue(maxWorkers)
+
+	var running, maxRunning atomic.Int32
+	for i := range 20 {
+		roomID := id.RoomID("!" + string(rune('a'+i)) + ":example.com")
+		for range 5 {
+			q.Enqueue(roomID, func() {
+				current := running.Add(1)
+				for {
+					previous := maxRunning.Load()
+					if current <= previous || maxRunning.CompareAndSwap(previous, current) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				running.Add(-1)
+			})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := q.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if got := maxRunning.Load(); got > maxWorkers {
+		t.Fatalf("%d jobs ran at the same time, expected at most %d", got, maxWorkers)
+	} else if got < 2 {
+		t.Fatalf("jobs of different rooms didn't run concurrently")
+	}
+}
+
+func TestRoomQueueDrainTimesOut(t *testing.T) {
+	q := NewRoomQueue(1)
+	release := make(chan struct{})
+	q.Enqueue("!room:example.com", func() { <-release })
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := q.Drain(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Drain returned %v, expected a deadline exceeded error", err)
+	} else if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Drain took %s to time out", elapsed)
+	}
+}
+
+func TestRoomQueueDrainWaitsForRequeuedJobs(t *testing.T) {
+	q := NewRoomQueue(2)
+
+	var ran atomic.Bool
+	q.Enqueue("!a:example.com", func() {
+		// The job for the other room is queued while this job is running.
+		q.Enqueue("!b:example.com", func() {
+			time.Sleep(10 * time.Millisecond)
+			ran.Store(true)
+		})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	} else if !ran.Load() {
+		t.Fatalf("Drain returned before the requeued job finished")
+	}
+	if err := q.Drain(ctx); err != nil {
+		t.Fatalf("Drain of an empty queue: %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// roomStateEventTypes are the state events that the bot reacts to.
+var roomStateEventTypes = []event.Type{
+	event.StateRoomName,
+	event.StateTopic,
+	event.StateRoomAvatar,
+	event.StateMember,
+	event.StateBridge,
+	event.StateHalfShotBridge,
+}
+
+// HandleRoomStateChange handles a change of the state of a room that has a
+// Chatwoot conversation. It is only called for state events in the timeline.
+func HandleRoomStateChange(ctx context.Context, evt *event.Event) {
+	log := zerolog.Ctx(ctx).With().Str("component", "handle_room_state_change").Logger()
+	ctx = log.WithContext(ctx)
+
+	conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, evt.RoomID)
+	if err != nil {
+		log.Debug().Err(err).Msg("no Chatwoot conversation associated with this room")
+		return
+	}
+	log = log.With().Int("conversation_id", int(conversationID)).Logger()
+	ctx = log.WithContext(ctx)
+
+	if configuration.RoomActivityNotes {
+		if note := describeRoomStateChange(evt); note != "" {
+			DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send room activity note to %d", conversationID), func(ctx context.Context) (*chatwootapi.Message, error) {
+				return chatwootAPI.SendPrivateMessage(ctx, conversationID, note)
+			})
+		}
+	}
+
+	state, err := client.State(ctx, evt.RoomID)
+	if err != nil {
+		log.Err(err).Msg("failed to get room state")
+		return
+	}
+
+	if evt.Type == event.StateRoomName || evt.Type == event.StateMember {
+		if err := updateRoomAdditionalAttributes(ctx, conversationID, state); err != nil {
+			log.Err(err).Msg("failed to update room additional attributes")
+		}
+	}
+
+	UpdateCustomAttributes(ctx, conversationID, evt.RoomID, evt, state)
+}
+
+// formatUser formats a user for an activity note, including their
+// displayname if it is known.
+func formatUser(userID id.UserID, displayname string) string {
+	if displayname == "" || displayname == userID.String() {
+		return userID.String()
+	}
+	return fmt.Sprintf("%s (%s)", displayname, userID)
+}
+
+// describeRoomStateChange returns the private note that describes the state
+// change to the agents, or "" if the change is not interesting to them.
+func describeRoomStateChange(evt *event.Event) string {
+	var prev *event.Content
+	if evt.Unsigned.PrevContent != nil {
+		prev = evt.Unsigned.PrevContent
+		_ = prev.ParseRaw(evt.Type)
+	}
+
+	switch evt.Type {
+	case event.StateRoomName:
+		name := evt.Content.AsRoomName().Name
+		if name == "" {
+			return fmt.Sprintf("**%s removed the room name.**", evt.Sender)
+		}
+		return fmt.Sprintf("**%s renamed the room to \"%s\".**", evt.Sender, name)
+	case event.StateTopic:
+		topic := evt.Content.AsTopic().Topic
+		if topic == "" {
+			return fmt.Sprintf("**%s removed the room topic.**", evt.Sender)
+		}
+		return fmt.Sprintf("**%s changed the room topic to:** %s", evt.Sender, topic)
+	case event.StateRoomAvatar:
+		if evt.Content.AsRoomAvatar().URL == "" {
+			return fmt.Sprintf("**%s removed the room avatar.**", evt.Sender)
+		}
+		return fmt.Sprintf("**%s changed the room avatar.**", evt.Sender)
+	case event.StateMember:
+		return describeMembershipChange(evt, prev)
+	}
+	return ""
+}
+
+func describeMembershipChange(evt *event.Event, prev *event.Content) string {
+	target := id.UserID(evt.GetStateKey())
+	if target == configuration.Username {
+		return ""
+	}
+	member := evt.Content.AsMember()
+	prevMember := &event.MemberEventContent{Membership: event.MembershipLeave}
+	if prev != nil {
+		prevMember = prev.AsMember()
+	}
+	targetName := member.Displayname
+	if targetName == "" {
+		targetName = prevMember.Displayname
+	}
+	user := formatUser(target, targetName)
+
+	var note string
+	switch member.Membership {
+	case event.MembershipJoin:
+		if prevMember.Membership != event.MembershipJoin {
+			note = fmt.Sprintf("**%s joined the room.**", user)
+		} else if member.Displayname != prevMember.Displayname {
+			note = fmt.Sprintf("**%s changed their display name to \"%s\".**", formatUser(target, prevMember.Displayname), member.Displayname)
+		}
+	case event.MembershipInvite:
+		note = fmt.Sprintf("**%s invited %s.**", evt.Sender, user)
+	case event.MembershipLeave:
+		switch {
+		case evt.Sender == target && prevMember.Membership == event.MembershipInvite:
+			note = fmt.Sprintf("**%s declined the invite.**", user)
+		case evt.Sender == target:
+			note = fmt.Sprintf("**%s left the room.**", user)
+		case prevMember.Membership == event.MembershipBan:
+			note = fmt.Sprintf("**%s unbanned %s.**", evt.Sender, user)
+		case prevMember.Membership == event.MembershipInvite:
+			note = fmt.Sprintf("**%s revoked the invite of %s.**", evt.Sender, user)
+		default:
+			note = fmt.Sprintf("**%s removed %s from the room.**", evt.Sender, user)
+		}
+	case event.MembershipBan:
+		note = fmt.Sprintf("**%s banned %s.**", evt.Sender, user)
+	}
+	if note != "" && member.Reason != "" {
+		note += " Reason: " + member.Reason
+	}
+	return note
+}
+
+// updateRoomAdditionalAttributes sets the room_name and room_members
+// additional attributes of the conversation to the current room name and
+// joined members from the room state.
+func updateRoomAdditionalAttributes(ctx context.Context, conversationID chatwootapi.ConversationID, state mautrix.RoomStateMap) error {
+	var roomName string
+	if nameEvent, ok := state[event.StateRoomName][""]; ok {
+		roomName = nameEvent.Content.AsRoomName().Name
+	}
+	members := []string{}
+	for stateKey, memberEvent := range state[event.StateMember] {
+		member := memberEvent.Content.AsMember()
+		if userID := id.UserID(stateKey); userID != configuration.Username && member.Membership == event.MembershipJoin {
+			members = append(members, formatUser(userID, member.Displayname))
+		}
+	}
+	slices.Sort(members)
+
+	conversation, err := chatwootAPI.GetChatwootConversation(ctx, conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to get conversation: %w", err)
+	}
+	additionalAttributes := map[string]any{}
+	maps.Copy(additionalAttributes, conversation.AdditionalAttributes)
+	additionalAttributes["room_name"] = roomName
+	additionalAttributes["room_members"] = members
+
+	// Compare through JSON types, since the current attributes were decoded
+	// from JSON.
+	if reflect.DeepEqual(conversation.AdditionalAttributes["room_name"], roomName) &&
+		reflect.DeepEqual(conversation.AdditionalAttributes["room_members"], toAnySlice(members)) {
+		return nil
+	}
+	return chatwootAPI.SetConversationAdditionalAttributes(ctx, conversationID, additionalAttributes)
+}
+
+func toAnySlice[T any](values []T) []any {
+	result := make([]any, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return result
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// HandleTombstone follows a room upgrade by joining the replacement room and
+// moving the conversation of the old room to it.
+func HandleTombstone(ctx context.Context, evt *event.Event) {
+	content := evt.Content.AsTombstone()
+	newRoomID := content.ReplacementRoom
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "handle_tombstone").
+		Stringer("new_room_id", newRoomID).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	if newRoomID == "" || newRoomID == evt.RoomID {
+		log.Warn().Msg("tombstone doesn't have a replacement room")
+		return
+	}
+
+	conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, evt.RoomID)
+	if err != nil {
+		log.Info().Err(err).Msg("no Chatwoot conversation associated with the upgraded room, not following the upgrade")
+		return
+	}
+	log = log.With().Int("conversation_id", int(conversationID)).Logger()
+	ctx = log.WithContext(ctx)
+
+	sendNote := func(note string) {
+		DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send room upgrade note to %d", conversationID), func(ctx context.Context) (*chatwootapi.Message, error) {
+			return chatwootAPI.SendPrivateMessage(ctx, conversationID, note)
+		})
+	}
+
+	if existingConversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, newRoomID); err == nil && existingConversationID == conversationID {
+		log.Debug().Msg("room upgrade was already followed")
+		return
+	} else if err == nil {
+		log.Warn().Int("existing_conversation_id", int(existingConversationID)).Msg("replacement room already has a conversation")
+		sendNote(fmt.Sprintf("**The Matrix room was upgraded, but the new room (%s) is already bridged to conversation %d.** Messages in the new room are bridged to that conversation.", newRoomID, existingConversationID))
+		return
+	}
+
+	// Move the conversation before joining, so that the events of the new
+	// room, which are only received after joining, are bridged to it rather
+	// than to a new conversation.
+	if err = stateStore.MoveConversationToUpgradedRoom(ctx, evt.RoomID, newRoomID, conversationID); err != nil {
+		log.Err(err).Msg("failed to move conversation to replacement room")
+		sendNote(fmt.Sprintf("**The Matrix room was upgraded, but moving the conversation to the new room (%s) failed.** Error: %s", newRoomID, err))
+		return
+	}
+
+	// The replacement room was created by the sender of the tombstone, so
+	// their server can be used to join it.
+	_, err = DoRetry(ctx, RetryMatrixSend, fmt.Sprintf("join replacement room %s", newRoomID), func(ctx context.Context) (*mautrix.RespJoinRoom, error) {
+		return client.JoinRoom(ctx, newRoomID.String(), &mautrix.ReqJoinRoom{Via: []string{evt.Sender.Homeserver()}})
+	})
+	if err != nil {
+		log.Err(err).Msg("failed to join replacement room")
+		if err := stateStore.RevertRoomUpgrade(ctx, evt.RoomID, newRoomID); err != nil {
+			log.Err(err).Msg("failed to move conversation back to the old room")
+		}
+		sendNote(fmt.Sprintf("**The Matrix room was upgraded, but joining the new room (%s) failed.** Messages in the new room will not be bridged. Error: %s", newRoomID, err))
+		return
+	}
+
+	_, err = client.SendStateEvent(ctx, newRoomID, chatwootConversationIDType, "", ChatwootConversationIDEventContent{
+		ConversationID: conversationID,
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to send conversation_id state event")
+	}
+
+	// The old room isn't bridged anymore, so stay out of it.
+	_, err = DoRetry(ctx, RetryMatrixSend, fmt.Sprintf("leave upgraded room %s", evt.RoomID), func(ctx context.Context) (*mautrix.RespLeaveRoom, error) {
+		return client.LeaveRoom(ctx, evt.RoomID, &mautrix.ReqLeave{Reason: "room was upgraded"})
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to leave upgraded room")
+	}
+
+	log.Info().Msg("moved conversation to replacement room")
+	sendNote(fmt.Sprintf("**The Matrix room was upgraded.** Messages are now bridged to and from the new room (%s).", newRoomID))
+}
+
+// findEventRoom returns the room that contains the event: either the current
+// room of the conversation, or one of the rooms that it was in before they
+// were upgraded.
+func findEventRoom(ctx context.Context, conversationID chatwootapi.ConversationID, roomID id.RoomID, eventID id.EventID) id.RoomID {
+	oldRoomIDs, err := stateStore.GetUpgradedRoomsForConversation(ctx, conversationID)
+	if err != nil || len(oldRoomIDs) == 0 {
+		return roomID
+	}
+	if _, err := client.GetEvent(ctx, roomID, eventID); err == nil {
+		return roomID
+	}
+	for _, oldRoomID := range oldRoomIDs {
+		if _, err := client.GetEvent(ctx, oldRoomID, eventID); err == nil {
+			return oldRoomID
+		}
+	}
+	return roomID
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// undecryptableEventPruneInterval is how often the queued events that are
+// older than the configured max age are removed.
+const undecryptableEventPruneInterval = 1 * time.Hour
+
+// undecryptableRetryLock makes sure that each queued event is only retried
+// once, even if the same session is received multiple times concurrently.
+var undecryptableRetryLock sync.Mutex
+
+// queueUndecryptableEvent stores an event that could not be decrypted so that
+// it can be bridged when its Megolm session arrives later.
+func queueUndecryptableEvent(ctx context.Context, evt *event.Event) error {
+	content, ok := evt.Content.Parsed.(*event.EncryptedEventContent)
+	if !ok {
+		return fmt.Errorf("event is not encrypted")
+	}
+	return stateStore.AddUndecryptableEvent(ctx, evt, content.SessionID)
+}
+
+// retryUndecryptableEvents retries decrypting the queued events that were
+// encrypted with a session that just arrived. Successfully decrypted events
+// are dispatched to the syncer so that they are bridged normally.
+func retryUndecryptableEvents(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "retry_undecryptable_events").
+		Stringer("room_id", roomID).
+		Stringer("session_id", sessionID).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	undecryptableRetryLock.Lock()
+	defer undecryptableRetryLock.Unlock()
+
+	events, err := stateStore.GetUndecryptableEventsForSession(ctx, roomID, sessionID)
+	if err != nil {
+		log.Err(err).Msg("failed to get undecryptable events for session")
+		return
+	} else if len(events) == 0 {
+		return
+	}
+
+	log.Info().Int("event_count", len(events)).Msg("retrying decryption of queued events")
+	for _, evt := range events {
+		log := log.With().Stringer("event_id", evt.ID).Logger()
+		ctx := log.WithContext(ctx)
+
+		decrypted, err := parseFetchedEvent(ctx, evt)
+		if err != nil {
+			log.Warn().Err(err).Msg("still failed to decrypt queued event")
+			continue
+		}
+		if err = stateStore.DeleteUndecryptableEvent(ctx, evt.ID); err != nil {
+			log.Err(err).Msg("failed to remove queued event, not bridging it to avoid duplicates")
+			continue
+		}
+		log.Info().Msg("decrypted queued event")
+
+		if conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, evt.RoomID); err == nil {
+			DoRetry(ctx, RetryChatwootSend, fmt.Sprintf("send recovered message note to %d", conversationID), func(ctx context.Context) (*chatwootapi.Message, error) {
+				return chatwootAPI.SendPrivateMessage(
+					ctx,
+					conversationID,
+					fmt.Sprintf("**Recovered Matrix event (%s) that previously failed to decrypt.** It is bridged below.", evt.ID))
+			})
+		}
+
+		decrypted.Mautrix.EventSource |= event.SourceDecrypted
+		client.Syncer.(mautrix.DispatchableSyncer).Dispatch(withReplayedEvent(ctx), decrypted)
+	}
+}
+
+// RunUndecryptableEventPruner periodically removes the queued events whose
+// session never arrived and that are older than the configured max age.
+func RunUndecryptableEventPruner(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("component", "undecryptable_event_pruner").Logger()
+	ctx = log.WithContext(ctx)
+
+	ticker := time.NewTicker(undecryptableEventPruneInterval)
+	defer ticker.Stop()
+	for {
+		pruned, err := stateStore.DeleteUndecryptableEventsBefore(ctx, time.Now().Add(-configuration.UndecryptableEventMaxAge))
+		if err != nil {
+			log.Err(err).Msg("failed to prune undecryptable events")
+		} else if pruned > 0 {
+			log.Info().Int64("pruned_count", pruned).Msg("pruned undecryptable events whose session never arrived")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// vCard is the subset of a vCard (RFC 6350) that is shown to agents.
+type vCard struct {
+	Name          string
+	Phones        []string
+	Emails        []string
+	Organizations []string
+	Addresses     []string
+	URLs          []string
+}
+
+var vCardUnescaper = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+// isVCard returns whether the given media message is a contact card.
+func isVCard(content *event.MessageEventContent) bool {
+	if content.Info != nil {
+		mimeType, _, _ := mime.ParseMediaType(content.Info.MimeType)
+		if mimeType == "text/vcard" || mimeType == "text/x-vcard" || mimeType == "text/directory" {
+			return true
+		}
+	}
+	filename := content.FileName
+	if filename == "" {
+		filename = content.Body
+	}
+	return strings.HasSuffix(strings.ToLower(filename), ".vcf")
+}
+
+// parseVCards parses all of the vCards in the given data. Properties that are
+// not shown to agents are ignored.
+func parseVCards(data string) []vCard {
+	// Unfold continuation lines.
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n ", "")
+	data = strings.ReplaceAll(data, "\n\t", "")
+
+	var cards []vCard
+	var current *vCard
+	for _, line := range strings.Split(data, "\n") {
+		property, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		name, _, _ := strings.Cut(property, ";")
+		// Strip the group prefix, for example item1.TEL
+		if _, after, grouped := strings.Cut(name, "."); grouped {
+			name = after
+		}
+		name = strings.ToUpper(name)
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			current = &vCard{}
+		case name == "END" && strings.EqualFold(value, "VCARD"):
+			if current != nil {
+				cards = append(cards, *current)
+			}
+			current = nil
+		case current == nil:
+			continue
+		case name == "FN":
+			current.Name = vCardUnescaper.Replace(value)
+		case name == "N" && current.Name == "":
+			// N is family;given;additional;prefix;suffix
+			parts := strings.Split(value, ";")
+			if len(parts) >= 2 {
+				current.Name = strings.TrimSpace(vCardUnescaper.Replace(parts[1] + " " + parts[0]))
+			} else {
+				current.Name = vCardUnescaper.Replace(value)
+			}
+		case name == "TEL":
+			current.Phones = append(current.Phones, strings.TrimPrefix(value, "tel:"))
+		case name == "EMAIL":
+			current.Emails = append(current.Emails, value)
+		case name == "ORG":
+			current.Organizations = append(current.Organizations, strings.Trim(vCardUnescaper.Replace(strings.ReplaceAll(value, ";", ", ")), ", "))
+		case name == "ADR":
+			// ADR is po-box;extended;street;locality;region;code;country
+			var parts []string
+			for _, part := range strings.Split(value, ";") {
+				if part = strings.TrimSpace(vCardUnescaper.Replace(part)); part != "" {
+					parts = append(parts, part)
+				}
+			}
+			if len(parts) > 0 {
+				current.Addresses = append(current.Addresses, strings.Join(parts, ", "))
+			}
+		case name == "URL":
+			current.URLs = append(current.URLs, value)
+		}
+	}
+	return cards
+}
+
+// formatVCardsForChatwoot renders contact cards as structured text.
+func formatVCardsForChatwoot(cards []vCard) string {
+	var formatted []string
+	for _, card := range cards {
+		lines := []string{fmt.Sprintf("👤 **Contact:** %s", card.Name)}
+		for _, phone := range card.Phones {
+			lines = append(lines, fmt.Sprintf("Phone: %s", phone))
+		}
+		for _, email := range card.Emails {
+			lines = append(lines, fmt.Sprintf("Email: %s", email))
+		}
+		for _, org := range card.Organizations {
+			lines = append(lines, fmt.Sprintf("Organization: %s", org))
+		}
+		for _, address := range card.Addresses {
+			lines = append(lines, fmt.Sprintf("Address: %s", address))
+		}
+		for _, url := range card.URLs {
+			lines = append(lines, fmt.Sprintf("URL: %s", url))
+		}
+		formatted = append(formatted, strings.Join(lines, "\n"))
+	}
+	return strings.Join(formatted, "\n\n")
+}